@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"crypto/ed25519"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Agent struct
+// 2022-01-01: renamed to 'Agent' from 'WindowsAgent'
+type Agent struct {
+	Hostname      string
+	Arch          string
+	AgentID       string
+	BaseURL       string
+	ApiURL        string
+	ApiPort       int
+	Token         string
+	AgentPK       int
+	Cert          string
+	ProgramDir    string
+	EXE           string
+	SystemDrive   string
+	Nssm          string
+	MeshInstaller string
+	MeshSystemEXE string
+	MeshSVC       string
+	PythonEnabled bool
+	PythonBinary  string
+	Headers       map[string]string
+	Logger        *logrus.Logger
+	Version       string
+	Debug         bool
+	rClient       *resty.Client
+	cpu           *CPUSampler
+
+	// ScriptSigningKeys when set, only scripts signed by one of these keys are allowed to run
+	ScriptSigningKeys []ed25519.PublicKey
+	// Policy local restrictions on what the server may run
+	Policy *Policy
+	// MaxOutputBytes per-stream limit of script output kept in memory and sent to the server
+	MaxOutputBytes int
+	// UploadLargeOutput uploads the complete output as artifacts when it exceeds MaxOutputBytes
+	UploadLargeOutput bool
+	// CheckConcurrency number of checks run at the same time by RunChecks
+	CheckConcurrency int
+}
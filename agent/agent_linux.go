@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	ps "github.com/elastic/go-sysinfo"
+	"github.com/go-resty/resty/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	AGENT_FOLDER      = "rmmagent"
+	AGENT_NAME_LONG   = "RMM Agent"
+	AGENT_TEMP_DIR    = "rmm"
+	AGENT_FILENAME    = "rmmagent"
+	AGENT_CONFIG_FILE = "/etc/rmmagent/agent.json"
+	// Agent state: check state, locks, maintenance windows, policy and the audit journal
+	AGENT_STATE_DIR = "/var/lib/rmmagent"
+	AGENT_LOG_DIR   = "/var/log/rmmagent"
+)
+
+// AgentConfig the Linux agent's settings, read from AGENT_CONFIG_FILE
+// These are the registry values of the Windows agent.
+type AgentConfig struct {
+	BaseURL           string   `json:"baseurl"`
+	AgentID           string   `json:"agentid"`
+	ApiURL            string   `json:"apiurl"`
+	Token             string   `json:"token"`
+	AgentPK           int      `json:"agentpk"`
+	Cert              string   `json:"cert"`
+	ScriptSigningKeys []string `json:"script_signing_keys"`
+	MaxOutputBytes    *int     `json:"max_output_bytes"`
+	UploadLargeOutput bool     `json:"upload_large_output"`
+	CheckConcurrency  int      `json:"check_concurrency"`
+}
+
+// LoadAgentConfig reads the agent's settings
+func LoadAgentConfig(path string) (AgentConfig, error) {
+	var cfg AgentConfig
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// New Initializes a new Agent with logger
+func New(logger *logrus.Logger, version string) *Agent {
+	host, _ := ps.Host()
+	info := host.Info()
+
+	cfg, err := LoadAgentConfig(AGENT_CONFIG_FILE)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Fatalln("Unable to load the agent configuration:", err)
+	}
+
+	var sigKeys []ed25519.PublicKey
+	if len(cfg.ScriptSigningKeys) > 0 {
+		sigKeys, err = ParseScriptSigningKeys(cfg.ScriptSigningKeys)
+		if err != nil {
+			// Refuse to start rather than silently running unsigned scripts
+			logger.Fatalln("Unable to load ScriptSigningKeys:", err)
+		}
+	}
+
+	maxOutput := DEFAULT_MAX_OUTPUT_BYTES
+	if cfg.MaxOutputBytes != nil {
+		maxOutput = *cfg.MaxOutputBytes
+	}
+	checkJobs := DEFAULT_CHECK_CONCURRENCY
+	if cfg.CheckConcurrency > 0 {
+		checkJobs = cfg.CheckConcurrency
+	}
+
+	policy, err := LoadPolicy(filepath.Join(AGENT_STATE_DIR, AGENT_POLICY_FILE))
+	if err != nil {
+		// Refuse to start rather than running without the intended restrictions
+		logger.Fatalln("Unable to load policy:", err)
+	}
+
+	headers := make(map[string]string)
+	if len(cfg.Token) > 0 {
+		headers["Content-Type"] = "application/json"
+		headers["Authorization"] = fmt.Sprintf("Token %s", cfg.Token)
+	}
+
+	restyC := resty.New()
+	restyC.SetBaseURL(cfg.BaseURL)
+	restyC.SetCloseConnection(true)
+	restyC.SetHeaders(headers)
+	restyC.SetTimeout(15 * time.Second)
+	restyC.SetDebug(logger.IsLevelEnabled(logrus.DebugLevel))
+	if len(cfg.Cert) > 0 {
+		restyC.SetRootCertificate(cfg.Cert)
+	}
+
+	exe, _ := os.Executable()
+	return &Agent{
+		Hostname:     info.Hostname,
+		Arch:         info.Architecture,
+		BaseURL:      cfg.BaseURL,
+		AgentID:      cfg.AgentID,
+		ApiURL:       cfg.ApiURL,
+		Token:        cfg.Token,
+		AgentPK:      cfg.AgentPK,
+		Cert:         cfg.Cert,
+		ProgramDir:   AGENT_STATE_DIR,
+		EXE:          exe,
+		PythonBinary: "python3",
+		Headers:      headers,
+		Logger:       logger,
+		Version:      version,
+		Debug:        logger.IsLevelEnabled(logrus.DebugLevel),
+		rClient:      restyC,
+		cpu:          NewCPUSampler(),
+
+		ScriptSigningKeys: sigKeys,
+		Policy:            policy,
+		MaxOutputBytes:    maxOutput,
+		UploadLargeOutput: cfg.UploadLargeOutput,
+		CheckConcurrency:  checkJobs,
+	}
+}
+
+// ShowStatus prints the agent's version and configuration
+func ShowStatus(version string) {
+	fmt.Println("RMM Version", version)
+	fmt.Println("Platform:", runtime.GOOS, runtime.GOARCH)
+	if _, err := LoadAgentConfig(AGENT_CONFIG_FILE); err != nil {
+		fmt.Println("Configuration:", err)
+		return
+	}
+	fmt.Println("Configuration:", AGENT_CONFIG_FILE)
+}
@@ -3,6 +3,7 @@ package agent
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -24,7 +25,6 @@ import (
 	wapf "github.com/sarog/go-win64api"
 	rmm "github.com/sarog/rmmagent/shared"
 	"github.com/sarog/trmm-shared"
-	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/windows"
@@ -57,34 +57,6 @@ const (
 	AGENT_MODE_COMMAND = "command"
 )
 
-// Agent struct
-// 2022-01-01: renamed to 'Agent' from 'WindowsAgent'
-type Agent struct {
-	Hostname      string
-	Arch          string
-	AgentID       string
-	BaseURL       string
-	ApiURL        string
-	ApiPort       int
-	Token         string
-	AgentPK       int
-	Cert          string
-	ProgramDir    string
-	EXE           string
-	SystemDrive   string
-	Nssm          string
-	MeshInstaller string
-	MeshSystemEXE string
-	MeshSVC       string
-	PythonEnabled bool
-	PythonBinary  string
-	Headers       map[string]string
-	Logger        *logrus.Logger
-	Version       string
-	Debug         bool
-	rClient       *resty.Client
-}
-
 // New Initializes a new Agent with logger
 func New(logger *logrus.Logger, version string) *Agent {
 	host, _ := ps.Host()
@@ -118,6 +90,10 @@ func New(logger *logrus.Logger, version string) *Agent {
 		cert      string
 		pyStr     string
 		pyEnabled bool
+		sigKeys   []ed25519.PublicKey
+		maxOutput = DEFAULT_MAX_OUTPUT_BYTES
+		upload    bool
+		checkJobs = DEFAULT_CHECK_CONCURRENCY
 	)
 
 	// todo: 2021-12-31: migrate to DPAPI?
@@ -159,6 +135,37 @@ func New(logger *logrus.Logger, version string) *Agent {
 			key.SetStringValue(REG_RMM_PYENABLED, "false")
 		}
 		pyEnabled, _ = strconv.ParseBool(pyStr)
+
+		keys, _, err := key.GetStringsValue(REG_RMM_SCRIPTKEYS)
+		if err == nil {
+			sigKeys, err = ParseScriptSigningKeys(keys)
+			if err != nil {
+				// Refuse to start rather than silently running unsigned scripts
+				logger.Fatalln("Unable to load ScriptSigningKeys:", err)
+			}
+		}
+
+		if maxStr, _, err := key.GetStringValue(REG_RMM_MAXOUTPUT); err == nil {
+			if n, err := strconv.Atoi(maxStr); err == nil {
+				maxOutput = n
+			}
+		}
+
+		if uploadStr, _, err := key.GetStringValue(REG_RMM_UPLOADOUTPUT); err == nil {
+			upload, _ = strconv.ParseBool(uploadStr)
+		}
+
+		if jobsStr, _, err := key.GetStringValue(REG_RMM_CHECKCONCURRENCY); err == nil {
+			if n, err := strconv.Atoi(jobsStr); err == nil && n > 0 {
+				checkJobs = n
+			}
+		}
+	}
+
+	policy, err := LoadPolicy(filepath.Join(pd, AGENT_POLICY_FILE))
+	if err != nil {
+		// Refuse to start rather than running without the intended restrictions
+		logger.Fatalln("Unable to load policy:", err)
 	}
 
 	headers := make(map[string]string)
@@ -201,6 +208,13 @@ func New(logger *logrus.Logger, version string) *Agent {
 		Version:       version,
 		Debug:         logger.IsLevelEnabled(logrus.DebugLevel),
 		rClient:       restyC,
+		cpu:           NewCPUSampler(),
+
+		ScriptSigningKeys: sigKeys,
+		Policy:            policy,
+		MaxOutputBytes:    maxOutput,
+		UploadLargeOutput: upload,
+		CheckConcurrency:  checkJobs,
 	}
 }
 
@@ -498,29 +512,12 @@ func (a *Agent) LoggedOnUser() string {
 
 // GetCPULoadAvg Retrieve CPU load average
 func (a *Agent) GetCPULoadAvg() int {
-	fallback := false
-
-	// 2022-01-02: Works in PowerShell 5.x and Core 7.x
-	// todo? | Measure-Object -Property LoadPercentage -Average | Select Average
-	cmd := "(Get-CimInstance -ClassName Win32_Processor).LoadPercentage"
-	load, _, _, err := a.RunScript(cmd, "powershell", []string{}, 20)
-
+	stats, err := a.cpu.Stats()
 	if err != nil {
-		a.Logger.Debugln(err)
-		fallback = true
-	}
-
-	i, _ := strconv.Atoi(load)
-
-	if fallback {
-		percent, err := cpu.Percent(10*time.Second, false)
-		if err != nil {
-			a.Logger.Debugln("Go CPU Check:", err)
-			return 0
-		}
-		return int(math.Round(percent[0]))
+		a.Logger.Debugln("CPU load average:", err)
+		return 0
 	}
-	return i
+	return int(math.Round(stats.Percent))
 }
 
 // ForceKillSalt kills all salt related processes
@@ -656,7 +653,16 @@ func (a *Agent) RecoverRPC() {
 }
 
 // RecoverCMD runs a shell recovery command
-func (a *Agent) RecoverCMD(command string) {
+// The command is authorized like a cmd shell rawcmd: it must pass the local policy, and be signed
+// (with no arguments) when script signing is enabled.
+func (a *Agent) RecoverCMD(command, signature string) error {
+	if err := a.Policy.FuncAllowed(NATS_CMD_RECOVERY_CMD); err != nil {
+		return err
+	}
+	if err := a.AuthorizeScript(NATS_CMD_RECOVERY_CMD, command, "cmd", []string{}, signature); err != nil {
+		return err
+	}
+
 	a.Logger.Infoln("Attempting shell recovery with command:", command)
 	// To prevent killing ourselves, prefix the command with 'cmd /C'
 	// so the parent process is now cmd.exe and not tacticalrmm.exe
@@ -665,7 +671,7 @@ func (a *Agent) RecoverCMD(command string) {
 		CreationFlags: windows.DETACHED_PROCESS | windows.CREATE_NEW_PROCESS_GROUP,
 		CmdLine:       fmt.Sprintf("cmd.exe /C %s", command), // properly escape in case double quotes are in the command
 	}
-	cmd.Start()
+	return cmd.Start()
 }
 
 func (a *Agent) Sync() {
@@ -1081,6 +1087,7 @@ func (a *Agent) CheckForRecovery() {
 
 	mode := r.Result().(*rmm.RecoveryAction).Mode
 	command := r.Result().(*rmm.RecoveryAction).ShellCMD
+	signature := r.Result().(*rmm.RecoveryAction).Signature
 
 	switch mode {
 	// 2021-12-31: api/tacticalrmm/apiv3/views.py:551
@@ -1093,7 +1100,9 @@ func (a *Agent) CheckForRecovery() {
 		a.RecoverRPC()
 	case AGENT_MODE_COMMAND:
 		// 2022-01-01: api/tacticalrmm/apiv3/views.py:552
-		a.RecoverCMD(command)
+		if err := a.RecoverCMD(command, signature); err != nil {
+			a.Logger.Errorln("Recovery command:", err)
+		}
 	default:
 		return
 	}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"time"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+// The server records needs_reboot through the Windows Update endpoint
+// 2021-12-31: api/tacticalrmm/apiv3/views.py:122
+const API_URL_NEEDSREBOOT = "/api/v3/winupdates/"
+
+// RunAgentService runs the check scheduler until the agent is stopped,
+// and reports whether the system needs a reboot
+// The Linux agent doesn't check in with the server otherwise: it only runs checks and their tasks.
+func (a *Agent) RunAgentService() {
+	a.Logger.Infoln("Agent service started")
+	go a.cpu.Run()
+	go a.rebootReporter()
+	a.CheckRunner()
+}
+
+func (a *Agent) rebootReporter() {
+	time.Sleep(time.Duration(randRange(30, 90)) * time.Second)
+	a.SendRebootStatus()
+	for range time.Tick(time.Duration(randRange(1500, 2100)) * time.Second) {
+		a.SendRebootStatus()
+	}
+}
+
+// SendRebootStatus reports whether the system needs a reboot
+func (a *Agent) SendRebootStatus() {
+	status, err := a.GetRebootStatus()
+	if err != nil {
+		a.Logger.Debugln("Reboot status:", err)
+	}
+	for _, reason := range status.Reasons {
+		a.Logger.Debugln("Reboot required by", reason.Source, reason.Detail, reason.Packages)
+	}
+
+	payload := rmm.AgentNeedsReboot{AgentID: a.AgentID, NeedsReboot: status.Required}
+	if _, err := a.rClient.R().SetBody(payload).Put(API_URL_NEEDSREBOOT); err != nil {
+		a.Logger.Debugln("NeedsReboot:", err)
+	}
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	AGENT_AUDIT_FILE = "audit.log"
+
+	// Maximum number of entries returned by a single export
+	AUDIT_EXPORT_LIMIT = 1000
+
+	AUDIT_STATUS_OK         = "ok"
+	AUDIT_STATUS_FAILED     = "respond_failed"
+	AUDIT_STATUS_DENIED     = "denied" // disabled function, or refused by the local policy or the script signature
+	AUDIT_STATUS_ERROR      = "error"
+	AUDIT_STATUS_DISPATCHED = "dispatched"
+	AUDIT_STATUS_UNKNOWN    = "unknown_func"
+	AUDIT_STATUS_INVALID    = "invalid_payload"
+)
+
+// AuditEntry a single remote action received by the RPC service
+// Every entry includes the hash of the previous one, so any modification breaks the chain
+type AuditEntry struct {
+	Seq         uint64 `json:"seq"`
+	Func        string `json:"func"`
+	PayloadHash string `json:"payload_sha256"`
+	ResultHash  string `json:"result_sha256,omitempty"`
+	User        string `json:"user,omitempty"`
+	Started     string `json:"started"`
+	Finished    string `json:"finished"`
+	Status      string `json:"status"`
+	ExitCode    *int   `json:"exit_code,omitempty"` // of scripts and commands
+	PrevHash    string `json:"prev_hash"`
+	Hash        string `json:"hash"`
+}
+
+// AuditJournal append-only, hash-chained log of remote actions
+type AuditJournal struct {
+	path string
+	mu   sync.Mutex
+	seq  uint64
+	last string
+}
+
+// OpenAuditJournal opens or creates the journal and resumes the chain from its last entry
+func OpenAuditJournal(path string) (*AuditJournal, error) {
+	j := &AuditJournal{path: path}
+	entries, err := readAuditEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		j.seq = entries[len(entries)-1].Seq
+		j.last = entries[len(entries)-1].Hash
+	}
+	return j, nil
+}
+
+// Append adds an entry to the end of the chain
+func (j *AuditJournal) Append(e AuditEntry) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e.Seq = j.seq + 1
+	e.PrevHash = j.last
+	e.Hash = auditHash(e)
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	j.seq = e.Seq
+	j.last = e.Hash
+	return nil
+}
+
+// VerifyAuditJournal walks the chain and returns the number of valid entries
+// The error identifies the first entry that doesn't match its hash or its predecessor
+func VerifyAuditJournal(path string) (int, error) {
+	entries, err := readAuditEntries(path)
+	if err != nil {
+		return 0, err
+	}
+
+	prev := ""
+	var seq uint64
+	for i, e := range entries {
+		if e.Seq != seq+1 {
+			return i, fmt.Errorf("entry %d: expected sequence %d, got %d", i+1, seq+1, e.Seq)
+		}
+		if e.PrevHash != prev {
+			return i, fmt.Errorf("entry %d: previous hash mismatch", e.Seq)
+		}
+		if auditHash(e) != e.Hash {
+			return i, fmt.Errorf("entry %d: hash mismatch", e.Seq)
+		}
+		prev = e.Hash
+		seq = e.Seq
+	}
+	return len(entries), nil
+}
+
+// ExportAuditJournal returns the entries within a sequence range and/or a time range
+// Zero values disable the corresponding bound
+func ExportAuditJournal(path string, from, to uint64, since, until time.Time) ([]AuditEntry, error) {
+	entries, err := readAuditEntries(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]AuditEntry, 0)
+	for _, e := range entries {
+		if from > 0 && e.Seq < from {
+			continue
+		}
+		if to > 0 && e.Seq > to {
+			break
+		}
+		started, _ := time.Parse(time.RFC3339Nano, e.Started)
+		if !since.IsZero() && started.Before(since) {
+			continue
+		}
+		if !until.IsZero() && started.After(until) {
+			continue
+		}
+		ret = append(ret, e)
+		if len(ret) >= AUDIT_EXPORT_LIMIT {
+			break
+		}
+	}
+	return ret, nil
+}
+
+// VerifyAuditLog verifies the agent's audit journal and prints the result
+func (a *Agent) VerifyAuditLog() error {
+	path := filepath.Join(a.ProgramDir, AGENT_AUDIT_FILE)
+	n, err := VerifyAuditJournal(path)
+	if err != nil {
+		fmt.Printf("Audit journal %s is INVALID after %d valid entries: %s\n", path, n, err)
+		return err
+	}
+	fmt.Printf("Audit journal %s is valid (%d entries)\n", path, n)
+	return nil
+}
+
+func readAuditEntries(path string) ([]AuditEntry, error) {
+	ret := make([]AuditEntry, 0)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("entry %d: %s", len(ret)+1, err)
+		}
+		ret = append(ret, e)
+	}
+	return ret, scanner.Err()
+}
+
+// auditHash hashes an entry, excluding its own hash
+func auditHash(e AuditEntry) string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	return sha256Hex(b)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
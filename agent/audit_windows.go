@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"errors"
+	"os/exec"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// Record appends an entry for a remote action
+func (j *AuditJournal) Record(p *NatsMsg, payload, result []byte, started time.Time, status string, exitCode *int) error {
+	e := AuditEntry{
+		PayloadHash: sha256Hex(payload),
+		Started:     started.UTC().Format(time.RFC3339Nano),
+		Finished:    time.Now().UTC().Format(time.RFC3339Nano),
+		Status:      status,
+		ExitCode:    exitCode,
+	}
+	if p != nil {
+		e.Func = p.Func
+		e.User = p.User
+	}
+	if result != nil {
+		e.ResultHash = sha256Hex(result)
+	}
+	return j.Append(e)
+}
+
+// auditedMsg records an audit entry with the outcome of the RPC handler when it responds
+// Handlers that keep working after responding call Defer, and Finish once the work has run.
+type auditedMsg struct {
+	*nats.Msg
+	journal *AuditJournal
+	payload *NatsMsg
+	started time.Time
+
+	mu         sync.Mutex
+	status     string
+	exitCode   *int
+	deferred   bool
+	response   []byte
+	respondErr error
+}
+
+// Outcome sets the status recorded for the action, and the exit code of a script or command
+func (m *auditedMsg) Outcome(status string, exitCode *int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status = status
+	m.exitCode = exitCode
+}
+
+// Defer postpones the entry until Finish is called
+func (m *auditedMsg) Defer() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deferred = true
+}
+
+func (m *auditedMsg) Respond(data []byte) error {
+	err := m.Msg.Respond(data)
+
+	m.mu.Lock()
+	m.response = data
+	m.respondErr = err
+	deferred := m.deferred
+	m.mu.Unlock()
+
+	if !deferred {
+		m.record()
+	}
+	return err
+}
+
+// Finish records the entry of a deferred action with its outcome
+func (m *auditedMsg) Finish(status string, exitCode *int) {
+	m.Outcome(status, exitCode)
+	m.record()
+}
+
+func (m *auditedMsg) record() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.status
+	if status == "" {
+		status = AUDIT_STATUS_OK
+	}
+	if m.respondErr != nil {
+		status = AUDIT_STATUS_FAILED
+	}
+	m.journal.Record(m.payload, m.Msg.Data, m.response, m.started, status, m.exitCode)
+}
+
+// errorStatus returns AUDIT_STATUS_ERROR when err is set, otherwise AUDIT_STATUS_OK
+func errorStatus(err error) string {
+	if err != nil {
+		return AUDIT_STATUS_ERROR
+	}
+	return AUDIT_STATUS_OK
+}
+
+// refusalStatus returns AUDIT_STATUS_DENIED when err is a policy or signature refusal, otherwise errorStatus(err)
+func refusalStatus(err error) string {
+	var polErr *PolicyError
+	var sigErr *ScriptSignatureError
+	if errors.As(err, &polErr) || errors.As(err, &sigErr) {
+		return AUDIT_STATUS_DENIED
+	}
+	return errorStatus(err)
+}
+
+// commandOutcome returns the status and exit code of a command that returned err
+func commandOutcome(err error) (string, *int) {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		return AUDIT_STATUS_ERROR, &code
+	}
+	if err != nil {
+		return AUDIT_STATUS_ERROR, nil
+	}
+	code := 0
+	return AUDIT_STATUS_OK, &code
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const (
+	API_URL_CHECKRUN_SUMMARY = "/api/v3/checkrunsummary/"
+
+	// Number of checks run at the same time by RunChecks, unless set in the registry
+	DEFAULT_CHECK_CONCURRENCY = 4
+
+	// How long a check without its own timeout may run, in seconds
+	CHECK_RUN_TIMEOUT = 120
+	// Added to a check's own timeout, which the check enforces itself, before the run is abandoned
+	CHECK_TIMEOUT_GRACE = 15
+)
+
+// CheckRunRecord how a single check went during a run
+type CheckRunRecord struct {
+	ID        int       `json:"id"`
+	CheckType string    `json:"check_type"`
+	Started   time.Time `json:"started"`
+	Duration  float64   `json:"duration"` // seconds
+	TimedOut  bool      `json:"timed_out"`
+	Skipped   bool      `json:"skipped,omitempty"` // still running from an earlier run
+	Unknown   bool      `json:"unknown_type,omitempty"`
+}
+
+// CheckRunSummary a run of all the agent's checks, sent once every check has reported
+type CheckRunSummary struct {
+	AgentID     string           `json:"agent_id"`
+	Forced      bool             `json:"forced"`
+	Started     time.Time        `json:"started"`
+	Finished    time.Time        `json:"finished"`
+	Concurrency int              `json:"concurrency"`
+	Checks      []CheckRunRecord `json:"checks"`
+}
+
+// RunCheckPool runs the checks in order of their id, at most concurrency at a time
+// winsvc and eventlog checks run one at a time. Records are returned in the same order.
+// The maintenance windows are loaded once and shared by every check of the run.
+func (a *Agent) RunCheckPool(ctx context.Context, checks []rmm.Check, concurrency int, r *resty.Client) []CheckRunRecord {
+	ordered := make([]rmm.Check, len(checks))
+	copy(ordered, checks)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].CheckPK < ordered[j].CheckPK
+	})
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx = a.withMaintenanceWindows(ctx)
+	serial := newSerialSlots()
+
+	records := make([]CheckRunRecord, len(ordered))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				records[i], _ = a.runCheckTimeout(ctx, ordered[i], serial[ordered[i].CheckType], r)
+			}
+		}()
+	}
+
+	for i := range ordered {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return records
+}
+
+// newSerialSlots returns the slots of the check types that run one at a time
+func newSerialSlots() map[string]chan struct{} {
+	return map[string]chan struct{}{
+		CHECK_TYPE_WINSVC:   make(chan struct{}, 1),
+		CHECK_TYPE_EVENTLOG: make(chan struct{}, 1),
+	}
+}
+
+// runCheckTimeout runs a check until it reports or its timeout expires
+// The timeout includes waiting for the check's serial slot. The slot and the check's run lock are held
+// until the check returns, and finished is closed then, so a check that outlives its timeout is never
+// run again before it exits: a run that finds the lock held is skipped.
+// A check that times out is cancelled through its context, its result is still reported if it finishes.
+func (a *Agent) runCheckTimeout(ctx context.Context, check rmm.Check, serial chan struct{}, r *resty.Client) (rec CheckRunRecord, finished <-chan struct{}) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout(check, CHECK_RUN_TIMEOUT)+CHECK_TIMEOUT_GRACE*time.Second)
+	defer cancel()
+
+	rec = CheckRunRecord{ID: check.CheckPK, CheckType: check.CheckType, Started: time.Now().UTC()}
+	exited := make(chan struct{})
+	if serial != nil {
+		select {
+		case serial <- struct{}{}:
+		case <-ctx.Done():
+			close(exited)
+			rec.TimedOut = true
+			rec.Duration = time.Since(rec.Started).Seconds()
+			a.Logger.Errorln("Check", check.CheckPK, "did not start within", checkTimeout(check, CHECK_RUN_TIMEOUT))
+			return rec, exited
+		}
+	}
+
+	type result struct {
+		known   bool
+		skipped bool
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer close(exited)
+		if serial != nil {
+			defer func() { <-serial }()
+		}
+		lock, err := a.AcquireLock(checkRunLock(check.CheckPK))
+		if err != nil {
+			if !errors.Is(err, ErrLocked) {
+				a.Logger.Errorln("Check", check.CheckPK, err)
+			}
+			done <- result{skipped: true}
+			return
+		}
+		defer lock.Release()
+		done <- result{known: a.RunCheck(ctx, check, r)}
+	}()
+
+	select {
+	case res := <-done:
+		rec.Skipped = res.skipped
+		rec.Unknown = !res.known && !res.skipped
+		if res.skipped {
+			a.Logger.Debugln("Check", check.CheckPK, "is still running, skipped")
+		} else if !res.known {
+			a.Logger.Debugln("RunChecks unknown check type:", check.CheckType)
+		}
+	case <-ctx.Done():
+		rec.TimedOut = true
+		a.Logger.Errorln("Check", check.CheckPK, "did not finish within", checkTimeout(check, CHECK_RUN_TIMEOUT))
+	}
+	rec.Duration = time.Since(rec.Started).Seconds()
+	return rec, exited
+}
+
+// sendCheckRunSummary reports a completed run
+func (a *Agent) sendCheckRunSummary(summary CheckRunSummary) {
+	resp, err := a.rClient.R().SetBody(summary).Post(API_URL_CHECKRUN_SUMMARY)
+	if err != nil {
+		a.Logger.Debugln(err)
+		return
+	}
+	if resp.IsError() {
+		a.Logger.Debugln("Check run summary response code:", resp.StatusCode())
+	}
+}
@@ -0,0 +1,30 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func TestRunCheckTimeoutSkipsRunningCheck(t *testing.T) {
+	a := newTestAgent(t)
+	check := rmm.Check{CheckPK: 7, CheckType: "unknown"}
+
+	lock, err := a.AcquireLock(checkRunLock(check.CheckPK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, finished := a.runCheckTimeout(context.Background(), check, nil, nil)
+	<-finished
+	if !rec.Skipped || rec.Unknown {
+		t.Errorf("run while the check is running = %+v, want skipped", rec)
+	}
+
+	lock.Release()
+	rec, finished = a.runCheckTimeout(context.Background(), check, nil, nil)
+	<-finished
+	if rec.Skipped || !rec.Unknown {
+		t.Errorf("run = %+v, want an unknown check type", rec)
+	}
+}
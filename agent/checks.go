@@ -0,0 +1,439 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+const (
+	// todo: 2022-01-02: consolidate these elsewhere
+	API_URL_CHECKRUNNER = "/api/v3/checkrunner/"
+
+	// Check Types
+	CHECK_TYPE_DISKSPACE = "diskspace"
+	CHECK_TYPE_CPULOAD   = "cpuload"
+	CHECK_TYPE_MEMORY    = "memory"
+	CHECK_TYPE_PING      = "ping"
+	CHECK_TYPE_SCRIPT    = "script"
+	CHECK_TYPE_WINSVC    = "winsvc"
+	CHECK_TYPE_EVENTLOG  = "eventlog"
+	CHECK_TYPE_HTTP      = "http"
+	CHECK_TYPE_TCP       = "tcp"
+	CHECK_TYPE_TLSCERT   = "tlscert"
+	CHECK_TYPE_DNS       = "dns"
+	CHECK_TYPE_PROCESS   = "process"
+	CHECK_TYPE_FILE      = "file"
+	CHECK_TYPE_LOGFILE   = "logfile"
+	CHECK_TYPE_NAGIOS    = "nagios"
+	CHECK_TYPE_SMART     = "smart"
+	CHECK_TYPE_RAID      = "raid"
+	CHECK_TYPE_SENSORS   = "sensors"
+	CHECK_TYPE_SYSTEMD   = "systemd"
+	CHECK_TYPE_TIMESYNC  = "timesync"
+
+	// Agent Modes
+	AGENT_MODE_CHECKRUNNER = "checkrunner"
+)
+
+// CheckRunner schedules and runs the checks within the agent service
+func (a *Agent) CheckRunner() {
+	a.Logger.Infoln("CheckRunner service started.")
+	sleepDelay := randRange(14, 22)
+	a.Logger.Debugf("Sleeping for %v seconds", sleepDelay)
+	time.Sleep(time.Duration(sleepDelay) * time.Second)
+	a.NewCheckScheduler().Run()
+}
+
+// RunChecks Run Checks
+func (a *Agent) RunChecks(force bool) error {
+	lock, err := a.AcquireLock(LOCK_CHECKS)
+	if err != nil {
+		if errors.Is(err, ErrLocked) {
+			a.lockBusy(LOCK_CHECKS)
+			return nil
+		}
+		a.Logger.Debugln(err)
+		return err
+	}
+	defer lock.Release()
+
+	data := rmm.AllChecks{}
+	var url string
+	if force {
+		// 2021-12-31: api/tacticalrmm/apiv3/views.py:229
+		url = fmt.Sprintf("/api/v3/%s/runchecks/", a.AgentID)
+	} else {
+		// 2021-12-31: api/tacticalrmm/apiv3/views.py:244
+		url = fmt.Sprintf("/api/v3/%s/checkrunner/", a.AgentID)
+	}
+
+	// 2021-12-31:
+	// 	api.tacticalrmm.apiv3.views.RunChecks.get
+	// 	api.tacticalrmm.apiv3.views.CheckRunner.get
+	r, err := a.rClient.R().Get(url)
+	if err != nil {
+		a.Logger.Debugln(err)
+		return err
+	}
+
+	if r.IsError() {
+		a.Logger.Debugln("CheckRunner response code:", r.StatusCode())
+		return nil
+	}
+
+	if err := json.Unmarshal(r.Body(), &data); err != nil {
+		a.Logger.Debugln(err)
+		return err
+	}
+	a.syncMaintenanceWindows(data.MaintenanceWindows)
+
+	summary := CheckRunSummary{
+		AgentID:     a.AgentID,
+		Forced:      force,
+		Started:     time.Now().UTC(),
+		Concurrency: a.CheckConcurrency,
+	}
+	summary.Checks = a.RunCheckPool(context.Background(), data.Checks, a.CheckConcurrency, a.rClient)
+	summary.Finished = time.Now().UTC()
+	a.sendCheckRunSummary(summary)
+	return nil
+}
+
+// RunCheck runs a single check and reports its result
+// Returns false if the check type is unknown or not supported on this platform
+func (a *Agent) RunCheck(ctx context.Context, check rmm.Check, r *resty.Client) bool {
+	if w := a.ActiveMaintenance(ctx, check.CheckType); w != nil {
+		a.maintenanceCheck(check, w, r)
+		return true
+	}
+
+	switch check.CheckType {
+	case CHECK_TYPE_DISKSPACE:
+		// 2021-12-31: api/tacticalrmm/checks/models.py:340
+		a.DiskCheck(ctx, check, r)
+	case CHECK_TYPE_CPULOAD:
+		// 2021-12-31: api/tacticalrmm/checks/models.py:315
+		a.CPULoadCheck(ctx, check, r)
+	case CHECK_TYPE_MEMORY:
+		a.MemCheck(ctx, check, r)
+	case CHECK_TYPE_PING:
+		// 2021-12-31: api/tacticalrmm/checks/models.py:407
+		a.PingCheck(ctx, check, r)
+	case CHECK_TYPE_SCRIPT:
+		// 2021-12-31: api/tacticalrmm/checks/models.py:368
+		a.ScriptCheck(ctx, check, r)
+	case CHECK_TYPE_NAGIOS:
+		a.NagiosCheck(ctx, check, r)
+	case CHECK_TYPE_HTTP:
+		a.HTTPCheck(ctx, check, r)
+	case CHECK_TYPE_TCP:
+		a.TCPCheck(ctx, check, r)
+	case CHECK_TYPE_TLSCERT:
+		a.TLSCertCheck(ctx, check, r)
+	case CHECK_TYPE_DNS:
+		a.DNSCheck(ctx, check, r)
+	case CHECK_TYPE_PROCESS:
+		a.ProcessCheck(ctx, check, r)
+	case CHECK_TYPE_FILE:
+		a.FileCheck(ctx, check, r)
+	case CHECK_TYPE_LOGFILE:
+		a.LogFileCheck(ctx, check, r)
+	case CHECK_TYPE_SMART:
+		a.SmartCheck(ctx, check, r)
+	case CHECK_TYPE_TIMESYNC:
+		a.TimeSyncCheck(ctx, check, r)
+	default:
+		return a.runPlatformCheck(ctx, check, r)
+	}
+	return true
+}
+
+// RunScriptEnv Runs a script with additional environment variables
+// Secrets are only passed as environment variables and are redacted from the output, including uploaded artifacts
+// Output beyond the agent's limit is truncated, and optionally uploaded as artifacts
+func (a *Agent) RunScriptEnv(ctx context.Context, code string, shell string, args []string, timeout int, env, secrets map[string]string) (stdout, stderr string, exitcode int, artifacts []OutputArtifact, e error) {
+	return a.runScriptEnv(ctx, code, shell, args, timeout, env, secrets, nil)
+}
+
+// RunScript Runs a script
+func (a *Agent) RunScript(code string, shell string, args []string, timeout int) (stdout, stderr string, exitcode int, e error) {
+	stdout, stderr, exitcode, _, e = a.RunScriptEnv(context.Background(), code, shell, args, timeout, nil, nil)
+	return
+}
+
+// ScriptCheck Runs either a batch file, PowerShell or Python script,
+// and sends the results back to the server
+func (a *Agent) ScriptCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	var (
+		stdout, stderr string
+		retcode        int
+		artifacts      []OutputArtifact
+	)
+
+	start := time.Now()
+	if err := a.AuthorizeScript(data.CheckType, data.Script.Code, data.Script.Shell, data.ScriptArgs, data.Script.Signature); err != nil {
+		a.Logger.Errorln("Script check", data.CheckPK, err)
+		stderr, retcode = err.Error(), SCRIPT_EXIT_UNVERIFIED
+	} else {
+		stdout, stderr, retcode, artifacts, _ = a.RunScriptEnv(ctx, data.Script.Code, data.Script.Shell, data.ScriptArgs, data.Timeout, data.Script.Env, data.Script.Secrets)
+	}
+
+	// 2021-12-31: api/tacticalrmm/checks/models.py:368
+	payload := map[string]interface{}{
+		"id":      data.CheckPK,
+		"stdout":  stdout,
+		"stderr":  stderr,
+		"retcode": retcode,
+		"runtime": time.Since(start).Seconds(),
+	}
+	if len(artifacts) > 0 {
+		payload["artifacts"] = artifacts
+	}
+
+	// 2021-12-31: api/tacticalrmm/apiv3/views.py:280
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// NagiosCheck runs a Monitoring Plugins compatible plugin, or a script when no plugin_path is set,
+// and interprets its return code and performance data
+// Plugins are run directly with the check's script_args, they are authorized like a script whose code is the path.
+func (a *Agent) NagiosCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	var (
+		stdout, stderr string
+		retcode        int
+		artifacts      []OutputArtifact
+		perf           = NewPerfDataWriter()
+	)
+
+	start := time.Now()
+	code, shell := data.Script.Code, data.Script.Shell
+	if data.PluginPath != "" {
+		code, shell = data.PluginPath, NAGIOS_PLUGIN_SHELL
+	}
+	if err := a.AuthorizeScript(data.CheckType, code, shell, data.ScriptArgs, data.Script.Signature); err != nil {
+		a.Logger.Errorln("Nagios check", data.CheckPK, err)
+		stderr, retcode = err.Error(), NAGIOS_UNKNOWN
+	} else if data.PluginPath != "" {
+		stdout, stderr, retcode, artifacts = a.RunPlugin(ctx, data.PluginPath, data.ScriptArgs, checkTimeout(data, CHECK_RUN_TIMEOUT), data.Script.Env, data.Script.Secrets, perf)
+	} else {
+		stdout, stderr, retcode, artifacts, _ = a.runScriptEnv(ctx, data.Script.Code, data.Script.Shell, data.ScriptArgs, data.Timeout, data.Script.Env, data.Script.Secrets, perf)
+	}
+
+	payload := map[string]interface{}{
+		"id":      data.CheckPK,
+		"stdout":  stdout,
+		"stderr":  stderr,
+		"retcode": retcode,
+		"runtime": time.Since(start).Seconds(),
+	}
+	if len(artifacts) > 0 {
+		payload["artifacts"] = artifacts
+	}
+
+	// The text comes from the returned output, the performance data from the complete one
+	result := ParseNagiosOutput(retcode, stdout)
+	result.PerfData = perf.Close()
+	payload["nagios"] = result
+	_, payload["status"], payload["severity"] = NagiosStatus(retcode)
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// DiskCheck checks disk usage
+// 2021-12-31: api/tacticalrmm/checks/models.py:340
+func (a *Agent) DiskCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	var payload map[string]interface{}
+
+	usage, err := disk.Usage(data.Disk)
+	if err != nil {
+		a.Logger.Debugln("Disk", data.Disk, err)
+
+		payload = map[string]interface{}{
+			"id":     data.CheckPK,
+			"exists": false,
+		}
+
+		if _, err := r.R().SetBody(payload).Patch(API_URL_CHECKRUNNER); err != nil {
+			a.Logger.Debugln(err)
+		}
+		return
+	}
+
+	payload = map[string]interface{}{
+		"id":           data.CheckPK,
+		"exists":       true,
+		"percent_used": usage.UsedPercent,
+		"total":        usage.Total,
+		"free":         usage.Free,
+		// todo: 2021-12-31: "more_info" ? api/tacticalrmm/checks/models.py:356
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// CPULoadCheck Checks the average processor load, per core usage, iowait, steal time and load averages
+func (a *Agent) CPULoadCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	stats, err := a.cpu.Stats()
+	if err != nil {
+		a.Logger.Debugln("CPU check:", err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	payload["percent"] = int(math.Round(stats.Percent))
+	payload["cpu"] = stats
+	if CPUThresholdsSet(data) {
+		payload["status"], payload["severity"] = CPUStatus(stats, data)
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// MemCheck Checks memory usage percentage, swap, commit charge and page faults
+func (a *Agent) MemCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	stats, err := GetMemoryStats(ctx)
+	if err != nil {
+		a.Logger.Debugln("Memory check:", err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	payload["percent"] = int(math.Round(stats.UsedPercent))
+	payload["memory"] = stats
+	if MemoryThresholdsSet(data) {
+		payload["status"], payload["severity"] = MemoryStatus(stats, data)
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// PingCheck Plays ping pong
+func (a *Agent) PingCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	stats, err := Ping(ctx, data.IP, data.PingCount)
+	if err != nil {
+		a.Logger.Debugln("Ping check:", err)
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		payload["output"] = fmt.Sprintf("Ping %s failed: %s", data.IP, err)
+	} else {
+		payload["status"], payload["severity"] = PingStatus(stats, data)
+		payload["output"] = stats.String()
+		payload["stats"] = stats
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// sendCheckResult reports the result of a check and runs its assigned tasks when it fails
+// Checks evaluated by the agent set "status" to passing or failing, the others are evaluated by the server.
+// Either way the status goes through the check's local state (see CheckRunState), and the assigned tasks
+// only run on its effective status and never while the check is flapping.
+// For checks evaluated by the agent, the effective status is also the one reported.
+// The check's state is locked until it is saved, so results of the same check from the scheduler
+// and from runchecks are all counted.
+func (a *Agent) sendCheckResult(ctx context.Context, data rmm.Check, payload map[string]interface{}, r *resty.Client) error {
+	lock, err := a.AcquireLockWait(checkStateLock(data.CheckPK), LOCK_CHECK_STATE_WAIT)
+	if err != nil {
+		a.Logger.Errorln("Check", data.CheckPK, "state:", err)
+		return err
+	}
+	defer lock.Release()
+
+	stateName := fmt.Sprintf("check-%d.json", data.CheckPK)
+	var state CheckRunState
+	if _, err := a.LoadCheckState(stateName, &state); err != nil {
+		a.Logger.Debugln("Check state:", err)
+	}
+
+	local, _ := payload["status"].(string)
+	agentEvaluated := local == "passing" || local == "failing"
+	if agentEvaluated {
+		state.Update(local, data)
+		payload["status"] = state.Status
+		payload["raw_status"] = local
+		payload["consecutive_failures"] = state.Failures
+		payload["flapping"] = state.Flapping
+		a.saveCheckRunState(stateName, state)
+	}
+
+	resp, err := r.R().SetBody(payload).Patch(API_URL_CHECKRUNNER)
+	if err != nil {
+		a.Logger.Debugln(err)
+		return err
+	}
+	if resp.IsError() {
+		a.Logger.Debugln("Check result response code:", resp.StatusCode())
+		return fmt.Errorf("checkrunner response code: %v", resp.StatusCode())
+	}
+
+	if !agentEvaluated {
+		status := DjangoStringResp(resp.String())
+		if status != "passing" && status != "failing" {
+			return nil
+		}
+		state.Update(status, data)
+		a.saveCheckRunState(stateName, state)
+	}
+
+	lock.Release()
+
+	if state.Flapping {
+		a.Logger.Debugln("Check", data.CheckPK, "is flapping, not running its tasks")
+		return nil
+	}
+	// The check may have started before a maintenance window
+	if w := a.ActiveMaintenance(ctx, data.CheckType); w != nil {
+		a.Logger.Debugln("Check", data.CheckPK, "is in maintenance window", w.ID+", not running its tasks")
+		return nil
+	}
+	a.handleAssignedTasks(state.Status, data.AssignedTasks)
+	return nil
+}
+
+func (a *Agent) saveCheckRunState(name string, state CheckRunState) {
+	if err := a.SaveCheckState(name, state); err != nil {
+		a.Logger.Errorln("Unable to save check state:", err)
+	}
+}
+
+func (a *Agent) handleAssignedTasks(status string, tasks []rmm.AssignedTask) {
+	if len(tasks) > 0 && DjangoStringResp(status) == "failing" {
+		var wg sync.WaitGroup
+		for _, t := range tasks {
+			if t.Enabled {
+				wg.Add(1)
+				go func(pk int, wg *sync.WaitGroup) {
+					defer wg.Done()
+					a.RunTask(pk)
+				}(t.TaskPK, &wg)
+			}
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,428 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DNS_CHECK_DEFAULT_TIMEOUT = 5
+	DNS_CHECK_DEFAULT_TYPE    = "A"
+)
+
+// DNSResult answers and response details of a dns check query
+type DNSResult struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Resolver   string   `json:"resolver"` // "system" when the OS resolver is used
+	RCode      string   `json:"rcode"`
+	Answers    []string `json:"answers"`
+	ResponseMS int64    `json:"response_ms"`
+}
+
+// DNSCheck resolves a name and verifies the answers
+func (a *Agent) DNSCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	result, err := ResolveDNS(ctx, data)
+	if err != nil {
+		a.Logger.Debugln("DNS check", data.DNSName, err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	assertions := DNSAssertions(result, data)
+	payload["result"] = result
+	payload["assertions"] = assertions
+	payload["status"] = assertionsStatus(nil, assertions)
+	if payload["status"] == "failing" {
+		payload["severity"] = "error"
+	} else if data.ErrorThreshold > 0 && result.ResponseMS >= int64(data.ErrorThreshold) {
+		payload["status"], payload["severity"] = "failing", "error"
+	} else if data.WarningThreshold > 0 && result.ResponseMS >= int64(data.WarningThreshold) {
+		payload["status"], payload["severity"] = "failing", "warning"
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// ResolveDNS queries the check's resolver, or the system resolver when none is set
+func ResolveDNS(ctx context.Context, data rmm.Check) (DNSResult, error) {
+	qtype := strings.ToUpper(data.RecordType)
+	if qtype == "" {
+		qtype = DNS_CHECK_DEFAULT_TYPE
+	}
+	result := DNSResult{Name: data.DNSName, Type: qtype, Answers: make([]string, 0)}
+	timeout := checkTimeout(data, DNS_CHECK_DEFAULT_TIMEOUT)
+
+	if data.Resolver == "" {
+		result.Resolver = "system"
+		return result, resolveSystem(ctx, &result, timeout)
+	}
+
+	result.Resolver = data.Resolver
+	if _, _, err := net.SplitHostPort(result.Resolver); err != nil {
+		result.Resolver = net.JoinHostPort(result.Resolver, "53")
+	}
+	return result, resolveDirect(ctx, &result, timeout)
+}
+
+// DNSAssertions checks the RCODE and that every expected answer was returned
+func DNSAssertions(result DNSResult, data rmm.Check) []CheckAssertion {
+	expected := strings.ToUpper(data.ExpectedRCode)
+	if expected == "" {
+		expected = "NOERROR"
+	}
+	rcode := CheckAssertion{Name: "rcode", Passed: result.RCode == expected}
+	if rcode.Passed {
+		rcode.Message = "rcode " + result.RCode
+	} else {
+		rcode.Message = fmt.Sprintf("rcode %s, expected %s", result.RCode, expected)
+	}
+	assertions := []CheckAssertion{rcode}
+
+	for _, want := range data.ExpectedAnswers {
+		assertion := CheckAssertion{Name: "answer:" + want}
+		for _, got := range result.Answers {
+			if normalizeDNS(got) == normalizeDNS(want) {
+				assertion.Passed = true
+				break
+			}
+		}
+		if assertion.Passed {
+			assertion.Message = want + " found"
+		} else {
+			assertion.Message = fmt.Sprintf("%s not found in %v", want, result.Answers)
+		}
+		assertions = append(assertions, assertion)
+	}
+	return assertions
+}
+
+// resolveSystem uses the OS resolver, which doesn't expose the RCODE
+// It is reported as NOERROR on success, NXDOMAIN when the name doesn't exist and SERVFAIL otherwise.
+// Go reports a name without records of the type (NODATA) like a missing one, so when the Go resolver
+// is used the responses it reads tell them apart: NODATA is reported as NOERROR with no answers.
+// Where the OS resolves names itself (Windows), a name that isn't found is always NXDOMAIN.
+func resolveSystem(ctx context.Context, result *DNSResult, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		rcodes   = &rcodeRecorder{}
+		resolver = rcodes.resolver()
+		name     = result.Name
+		answers  []string
+		err      error
+	)
+
+	start := time.Now()
+	switch result.Type {
+	case "A", "AAAA":
+		var ips []net.IP
+		network := "ip4"
+		if result.Type == "AAAA" {
+			network = "ip6"
+		}
+		ips, err = resolver.LookupIP(ctx, network, name)
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+	case "CNAME":
+		var cname string
+		if cname, err = resolver.LookupCNAME(ctx, name); err == nil {
+			answers = append(answers, cname)
+		}
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = resolver.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			answers = append(answers, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		var nss []*net.NS
+		nss, err = resolver.LookupNS(ctx, name)
+		for _, ns := range nss {
+			answers = append(answers, ns.Host)
+		}
+	case "TXT":
+		answers, err = resolver.LookupTXT(ctx, name)
+	case "PTR":
+		answers, err = resolver.LookupAddr(ctx, name)
+	case "SRV":
+		var srvs []*net.SRV
+		_, srvs, err = resolver.LookupSRV(ctx, "", "", name)
+		for _, srv := range srvs {
+			answers = append(answers, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+	default:
+		return fmt.Errorf("record type %s requires a resolver", result.Type)
+	}
+	result.ResponseMS = time.Since(start).Milliseconds()
+
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		result.RCode = "Success"
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound && rcodes.noData():
+		result.RCode = "Success"
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		result.RCode = "NameError"
+	case errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		return err
+	default:
+		result.RCode = "ServerFailure"
+	}
+	result.RCode = rcodeName(result.RCode)
+	result.Answers = append(result.Answers, answers...)
+	return nil
+}
+
+// rcodeRecorder records the RCODE of the UDP responses read by the Go resolver
+type rcodeRecorder struct {
+	mu     sync.Mutex
+	rcodes []dnsmessage.RCode
+}
+
+// resolver returns a Go resolver using the system's configuration, whose responses are recorded
+// Truncated responses are retried over TCP, their RCODE is already known from the UDP one.
+func (rr *rcodeRecorder) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, address)
+			if udp, ok := conn.(*net.UDPConn); ok && err == nil {
+				// Keeps implementing net.PacketConn, so the resolver still treats it as a datagram socket
+				return &rcodeConn{UDPConn: udp, recorder: rr}, nil
+			}
+			return conn, err
+		},
+	}
+}
+
+// noData returns true when a name was found without records of the queried type
+func (rr *rcodeRecorder) noData() bool {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for _, rcode := range rr.rcodes {
+		if rcode == dnsmessage.RCodeSuccess {
+			return true
+		}
+	}
+	return false
+}
+
+type rcodeConn struct {
+	*net.UDPConn
+	recorder *rcodeRecorder
+}
+
+func (c *rcodeConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	var p dnsmessage.Parser
+	if h, perr := p.Start(b[:n]); perr == nil && h.Response {
+		c.recorder.mu.Lock()
+		c.recorder.rcodes = append(c.recorder.rcodes, h.RCode)
+		c.recorder.mu.Unlock()
+	}
+	return n, err
+}
+
+// resolveDirect sends the query to a specific resolver over UDP, retrying over TCP when truncated
+func resolveDirect(ctx context.Context, result *DNSResult, timeout time.Duration) error {
+	qtype, ok := dnsTypes[result.Type]
+	if !ok {
+		return fmt.Errorf("unsupported record type %s", result.Type)
+	}
+
+	fqdn := result.Name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, err := dnsExchange(ctx, "udp", result.Resolver, query, timeout)
+	if err == nil && resp.Header.Truncated {
+		resp, err = dnsExchange(ctx, "tcp", result.Resolver, query, timeout)
+	}
+	result.ResponseMS = time.Since(start).Milliseconds()
+	if err != nil {
+		return err
+	}
+
+	result.RCode = rcodeName(resp.Header.RCode.String())
+	for _, answer := range resp.Answers {
+		if answer.Header.Type != qtype {
+			continue
+		}
+		if s := dnsAnswer(answer.Body); s != "" {
+			result.Answers = append(result.Answers, s)
+		}
+	}
+	return nil
+}
+
+// dnsExchange sends a query and returns its response
+// Over UDP, datagrams that aren't a response to the query, e.g. late responses to an earlier query,
+// are ignored until the timeout expires.
+func dnsExchange(ctx context.Context, network, server string, query []byte, timeout time.Duration) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		// TCP messages are prefixed with their length
+		msg := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		copy(msg[2:], query)
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(buf[:2]))
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+		return unpackResponse(buf[:n], query)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	for {
+		if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+		if msg, err := unpackResponse(buf[:n], query); err == nil {
+			return msg, nil
+		}
+	}
+}
+
+// unpackResponse parses a response, which must have the query's ID and question
+func unpackResponse(b, query []byte) (*dnsmessage.Message, error) {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		return nil, err
+	}
+	if !msg.Header.Response || msg.Header.ID != q.Header.ID {
+		return nil, fmt.Errorf("response ID mismatch")
+	}
+	if len(msg.Questions) > 0 && len(q.Questions) > 0 &&
+		(msg.Questions[0].Type != q.Questions[0].Type || !strings.EqualFold(msg.Questions[0].Name.String(), q.Questions[0].Name.String())) {
+		return nil, fmt.Errorf("response question mismatch")
+	}
+	return &msg, nil
+}
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// dnsAnswer formats an answer the same way as the system resolver lookups
+func dnsAnswer(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX.String())
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d", b.NS.String(), b.MBox.String(), b.Serial)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target.String())
+	case *dnsmessage.TXTResource:
+		return strings.Join(b.TXT, "")
+	}
+	return ""
+}
+
+// rcodeName converts dnsmessage RCode names to their usual form, e.g. RCodeNameError to NXDOMAIN
+func rcodeName(rcode string) string {
+	switch strings.TrimPrefix(rcode, "RCode") {
+	case "Success":
+		return "NOERROR"
+	case "FormatError":
+		return "FORMERR"
+	case "ServerFailure":
+		return "SERVFAIL"
+	case "NameError":
+		return "NXDOMAIN"
+	case "NotImplemented":
+		return "NOTIMP"
+	case "Refused":
+		return "REFUSED"
+	}
+	if n, err := strconv.Atoi(rcode); err == nil {
+		return "RCODE" + strconv.Itoa(n)
+	}
+	return rcode
+}
+
+// normalizeDNS makes answers comparable regardless of case and trailing dots
+func normalizeDNS(s string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), "."))
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	rmm "github.com/sarog/rmmagent/shared"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTestServer answers every query over UDP, after sending the datagrams returned by stray
+func dnsTestServer(t *testing.T, stray func(query dnsmessage.Message) [][]byte) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if err := q.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			for _, b := range stray(q) {
+				pc.WriteTo(b, addr)
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: q.Header.ID, Response: true},
+				Questions: q.Questions,
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+				}},
+			}
+			b, _ := resp.Pack()
+			pc.WriteTo(b, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestResolveDirectIgnoresStrayResponses(t *testing.T) {
+	server := dnsTestServer(t, func(q dnsmessage.Message) [][]byte {
+		other := dnsmessage.Message{Header: dnsmessage.Header{ID: q.Header.ID + 1, Response: true, RCode: dnsmessage.RCodeNameError}, Questions: q.Questions}
+		wrongID, _ := other.Pack()
+		return [][]byte{wrongID, []byte("garbage")}
+	})
+
+	data := rmm.Check{DNSName: "host.example.com", Resolver: server, Timeout: 2}
+	result, err := ResolveDNS(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RCode != "NOERROR" || len(result.Answers) != 1 || result.Answers[0] != "192.0.2.1" {
+		t.Errorf("ResolveDNS() = %+v", result)
+	}
+}
+
+func TestRcodeRecorder(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := &rcodeRecorder{}
+	c := &rcodeConn{UDPConn: conn, recorder: rr}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+
+	send := func(rcode dnsmessage.RCode) {
+		b, _ := (&dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: rcode}}).Pack()
+		server.WriteTo(b, conn.LocalAddr())
+		if _, err := c.Read(make([]byte, 512)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(dnsmessage.RCodeNameError)
+	if rr.noData() {
+		t.Error("noData() after NXDOMAIN")
+	}
+	send(dnsmessage.RCodeSuccess)
+	if !rr.noData() {
+		t.Error("noData() = false after an empty NOERROR response")
+	}
+}
@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+// Only the beginning of a file is searched by content_regex
+const FILE_CHECK_MAX_CONTENT = 10 * 1024 * 1024
+
+// FileState details of the file evaluated by a file check
+type FileState struct {
+	Path       string    `json:"path"`
+	Exists     bool      `json:"exists"`
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+	AgeMinutes int       `json:"age_minutes"`
+	Count      *int      `json:"count,omitempty"` // files matching file_glob
+}
+
+// FileCheck verifies the existence, size, age and content of a file, or the files matching a glob in a directory
+// With a glob, size, age and content are evaluated on the newest matching file
+func (a *Agent) FileCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	state, err := GetFileState(data)
+	if err != nil {
+		a.Logger.Debugln("File check", data.Path, err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	assertions := FileAssertions(state, data)
+	payload["file"] = state
+	payload["assertions"] = assertions
+	payload["status"] = assertionsStatus(nil, assertions)
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// GetFileState returns the state of the check's file, or of the newest file matching its glob
+func GetFileState(data rmm.Check) (FileState, error) {
+	if data.Path == "" {
+		return FileState{}, fmt.Errorf("file check requires a path")
+	}
+
+	path := data.Path
+	if data.FileGlob == "" {
+		return statFile(path)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(path, data.FileGlob))
+	if err != nil {
+		return FileState{}, fmt.Errorf("file_glob: %s", err)
+	}
+
+	var (
+		newest FileState
+		count  int
+	)
+	for _, m := range matches {
+		fs, err := statFile(m)
+		if err != nil || !fs.Exists {
+			continue
+		}
+		count++
+		if !newest.Exists || fs.Modified.After(newest.Modified) {
+			newest = fs
+		}
+	}
+	if !newest.Exists {
+		newest.Path = filepath.Join(path, data.FileGlob)
+	}
+	newest.Count = &count
+	return newest, nil
+}
+
+func statFile(path string) (FileState, error) {
+	fs := FileState{Path: path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fs, nil
+		}
+		return fs, err
+	}
+	if fi.IsDir() {
+		return fs, fmt.Errorf("%s is a directory", path)
+	}
+	fs.Exists = true
+	fs.Size = fi.Size()
+	fs.Modified = fi.ModTime().UTC()
+	fs.AgeMinutes = int(time.Since(fi.ModTime()).Minutes())
+	return fs, nil
+}
+
+// FileAssertions evaluates the check's rules against the file state
+// The file must exist unless should_exist is false, in which case it must not.
+// With a glob, should_exist false requires that no file matches, and min_count and max_count are ignored.
+func FileAssertions(fs FileState, data rmm.Check) []CheckAssertion {
+	assertions := make([]CheckAssertion, 0)
+	shouldExist := data.ShouldExist == nil || *data.ShouldExist
+
+	if fs.Count != nil {
+		count := CheckAssertion{Name: "count", Passed: *fs.Count == 0}
+		if shouldExist {
+			min := 1
+			if data.MinCount != nil {
+				min = *data.MinCount
+			}
+			count.Passed = *fs.Count >= min
+			if data.MaxCount != nil && *fs.Count > *data.MaxCount {
+				count.Passed = false
+			}
+		}
+		count.Message = fmt.Sprintf("%d files match %s", *fs.Count, data.FileGlob)
+		assertions = append(assertions, count)
+		if *fs.Count == 0 {
+			return assertions
+		}
+	} else {
+		exists := CheckAssertion{Name: "exists", Passed: fs.Exists == shouldExist}
+		if fs.Exists {
+			exists.Message = fs.Path + " exists"
+		} else {
+			exists.Message = fs.Path + " does not exist"
+		}
+		assertions = append(assertions, exists)
+		if !fs.Exists {
+			return assertions
+		}
+	}
+
+	if data.MinSizeBytes > 0 {
+		assertions = append(assertions, CheckAssertion{
+			Name:    "min_size",
+			Passed:  fs.Size >= data.MinSizeBytes,
+			Message: fmt.Sprintf("size %d bytes, min %d", fs.Size, data.MinSizeBytes),
+		})
+	}
+	if data.MaxSizeBytes > 0 {
+		assertions = append(assertions, CheckAssertion{
+			Name:    "max_size",
+			Passed:  fs.Size <= data.MaxSizeBytes,
+			Message: fmt.Sprintf("size %d bytes, max %d", fs.Size, data.MaxSizeBytes),
+		})
+	}
+	if data.MaxAgeMinutes > 0 {
+		assertions = append(assertions, CheckAssertion{
+			Name:    "max_age",
+			Passed:  fs.AgeMinutes <= data.MaxAgeMinutes,
+			Message: fmt.Sprintf("modified %d minutes ago, max %d", fs.AgeMinutes, data.MaxAgeMinutes),
+		})
+	}
+	if data.ContentRegex != "" {
+		assertions = append(assertions, contentAssertion(fs.Path, data.ContentRegex))
+	}
+	return assertions
+}
+
+func contentAssertion(path, expr string) CheckAssertion {
+	assertion := CheckAssertion{Name: "content_regex"}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		assertion.Message = err.Error()
+		return assertion
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		assertion.Message = err.Error()
+		return assertion
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(io.LimitReader(f, FILE_CHECK_MAX_CONTENT))
+	if err != nil {
+		assertion.Message = err.Error()
+		return assertion
+	}
+
+	assertion.Passed = re.Match(content)
+	if assertion.Passed {
+		assertion.Message = fmt.Sprintf("content matches %q", expr)
+	} else {
+		assertion.Message = fmt.Sprintf("content does not match %q", expr)
+	}
+	return assertion
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func TestFileAssertionsGlobShouldExist(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "backup.bak"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	yes, no := true, false
+	two := 2
+
+	tests := []struct {
+		name        string
+		glob        string
+		shouldExist *bool
+		minCount    *int
+		want        bool
+	}{
+		{"match", "*.bak", nil, nil, true},
+		{"no match", "*.tmp", nil, nil, false},
+		{"below min_count", "*.bak", &yes, &two, false},
+		{"should not exist, match", "*.bak", &no, nil, false},
+		{"should not exist, no match", "*.tmp", &no, nil, true},
+		{"should not exist ignores min_count", "*.tmp", &no, &two, true},
+	}
+	for _, tt := range tests {
+		data := rmm.Check{Path: dir, FileGlob: tt.glob, ShouldExist: tt.shouldExist, MinCount: tt.minCount}
+		fs, err := GetFileState(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertions := FileAssertions(fs, data)
+		if assertions[0].Name != "count" || assertions[0].Passed != tt.want {
+			t.Errorf("%s: %+v, want count passed %v", tt.name, assertions[0], tt.want)
+		}
+	}
+}
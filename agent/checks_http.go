@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const (
+	// Only the beginning of the response body is used for assertions
+	HTTP_CHECK_MAX_BODY = 1024 * 1024
+
+	HTTP_CHECK_DEFAULT_TIMEOUT   = 30
+	HTTP_CHECK_DEFAULT_REDIRECTS = 10
+)
+
+// CheckAssertion result of a single assertion made by a check
+type CheckAssertion struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message"`
+}
+
+// HTTPCheck requests a URL and verifies the response
+func (a *Agent) HTTPCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	statusCode, latency, assertions, err := RunHTTPCheck(ctx, data)
+	if err != nil {
+		a.Logger.Debugln("HTTP check", data.URL, err)
+		payload["more_info"] = err.Error()
+	} else {
+		payload["status_code"] = statusCode
+		payload["latency_ms"] = latency.Milliseconds()
+	}
+	payload["assertions"] = assertions
+	payload["status"] = assertionsStatus(err, assertions)
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// RunHTTPCheck performs the request described by an http check and evaluates its assertions
+func RunHTTPCheck(ctx context.Context, data rmm.Check) (int, time.Duration, []CheckAssertion, error) {
+	assertions := make([]CheckAssertion, 0)
+
+	method := strings.ToUpper(data.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	timeout := data.Timeout
+	if timeout <= 0 {
+		timeout = HTTP_CHECK_DEFAULT_TIMEOUT
+	}
+	maxRedirects := data.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = HTTP_CHECK_DEFAULT_REDIRECTS
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !data.FollowRedirects || len(via) >= maxRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	var body io.Reader
+	if data.Body != "" {
+		body = strings.NewReader(data.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, data.URL, body)
+	if err != nil {
+		return 0, 0, assertions, err
+	}
+	for k, v := range data.Headers {
+		req.Header.Set(k, v)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, time.Since(start), assertions, err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, HTTP_CHECK_MAX_BODY))
+	latency := time.Since(start)
+	if err != nil {
+		return resp.StatusCode, latency, assertions, err
+	}
+
+	assertions = append(assertions, statusAssertion(resp.StatusCode, data.ExpectedStatus))
+
+	if data.BodyRegex != "" {
+		assertion := CheckAssertion{Name: "body_regex"}
+		re, err := regexp.Compile(data.BodyRegex)
+		if err != nil {
+			assertion.Message = err.Error()
+		} else if re.Match(content) {
+			assertion.Passed = true
+			assertion.Message = fmt.Sprintf("body matches %q", data.BodyRegex)
+		} else {
+			assertion.Message = fmt.Sprintf("body does not match %q", data.BodyRegex)
+		}
+		assertions = append(assertions, assertion)
+	}
+
+	if len(data.JSONAssertions) > 0 {
+		var doc interface{}
+		jsonErr := json.Unmarshal(content, &doc)
+		for _, ja := range data.JSONAssertions {
+			assertion := CheckAssertion{Name: "json:" + ja.Path}
+			if jsonErr != nil {
+				assertion.Message = "invalid JSON response: " + jsonErr.Error()
+			} else {
+				assertion.Passed, assertion.Message = EvaluateJSONAssertion(ja, doc)
+			}
+			assertions = append(assertions, assertion)
+		}
+	}
+
+	return resp.StatusCode, latency, assertions, nil
+}
+
+// statusAssertion checks the response status code, any 2xx code passes when none are expected
+func statusAssertion(code int, expected []int) CheckAssertion {
+	assertion := CheckAssertion{Name: "status_code"}
+	if len(expected) == 0 {
+		assertion.Passed = code >= 200 && code < 300
+	}
+	for _, e := range expected {
+		if e == code {
+			assertion.Passed = true
+			break
+		}
+	}
+	if assertion.Passed {
+		assertion.Message = fmt.Sprintf("status %d", code)
+	} else {
+		assertion.Message = fmt.Sprintf("unexpected status %d", code)
+	}
+	return assertion
+}
+
+// assertionsStatus returns failing when the check errored or any assertion failed
+func assertionsStatus(err error, assertions []CheckAssertion) string {
+	if err != nil {
+		return "failing"
+	}
+	for _, assertion := range assertions {
+		if !assertion.Passed {
+			return "failing"
+		}
+	}
+	return "passing"
+}
+
+// EvaluateJSONAssertion checks the value at the assertion's path
+// Without an expected value, the assertion passes when the path exists
+func EvaluateJSONAssertion(ja rmm.JSONAssertion, doc interface{}) (bool, string) {
+	v, ok := JSONPathLookup(doc, ja.Path)
+	if !ok {
+		return false, fmt.Sprintf("%s not found", ja.Path)
+	}
+	if ja.Value == nil {
+		return true, fmt.Sprintf("%s exists", ja.Path)
+	}
+
+	got := jsonString(v)
+	if got == *ja.Value {
+		return true, fmt.Sprintf("%s is %q", ja.Path, got)
+	}
+	return false, fmt.Sprintf("%s is %q, expected %q", ja.Path, got, *ja.Value)
+}
+
+// JSONPathLookup resolves a simple JSON path such as $.data.items[0].name or data.items.0.name
+func JSONPathLookup(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	if path == "" {
+		return doc, true
+	}
+
+	cur := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			v, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			cur = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// jsonString formats a decoded JSON value for comparison, strings are compared without quotes
+func jsonString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
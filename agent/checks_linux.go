@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+// runScriptEnv runs a script, see RunScriptEnv
+// Shell scripts are run through their shebang, or /bin/sh when they don't have one.
+func (a *Agent) runScriptEnv(ctx context.Context, code string, shell string, args []string, timeout int, env, secrets map[string]string, tee io.Writer) (stdout, stderr string, exitcode int, artifacts []OutputArtifact, e error) {
+	dir := filepath.Join(os.TempDir(), AGENT_TEMP_DIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		a.Logger.Errorln(err)
+		return "", err.Error(), 85, nil, err
+	}
+
+	spillDir := ""
+	if a.UploadLargeOutput {
+		spillDir = dir
+	}
+
+	var (
+		outb    = NewOutputBuffer(a.MaxOutputBytes, spillDir)
+		errb    = NewOutputBuffer(a.MaxOutputBytes, spillDir)
+		exe     string
+		cmdArgs []string
+	)
+
+	tmpfn, err := os.CreateTemp(dir, "script-*")
+	if err != nil {
+		a.Logger.Errorln(err)
+		discardOutput(outb, errb)
+		return "", err.Error(), 85, nil, err
+	}
+	defer WipeFile(tmpfn.Name())
+
+	if _, err := tmpfn.WriteString(code); err != nil {
+		a.Logger.Errorln(err)
+		tmpfn.Close()
+		discardOutput(outb, errb)
+		return "", err.Error(), 85, nil, err
+	}
+	if err := tmpfn.Close(); err != nil {
+		a.Logger.Errorln(err)
+		discardOutput(outb, errb)
+		return "", err.Error(), 85, nil, err
+	}
+
+	switch {
+	case shell == "python":
+		exe = a.PythonBinary
+		cmdArgs = []string{tmpfn.Name()}
+	case len(code) > 2 && code[:2] == "#!":
+		if err := os.Chmod(tmpfn.Name(), 0700); err != nil {
+			discardOutput(outb, errb)
+			return "", err.Error(), 85, nil, err
+		}
+		exe = tmpfn.Name()
+	default:
+		exe = "/bin/sh"
+		cmdArgs = []string{tmpfn.Name()}
+	}
+	cmdArgs = append(cmdArgs, args...)
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.Command(exe, cmdArgs...)
+	// Secrets are redacted as the output is written, before it is truncated or spilled
+	var closeOutput func()
+	cmd.Stdout, cmd.Stderr, closeOutput = scriptWriters(outb, errb, tee, secrets)
+	// Own process group, so a timeout also kills the script's children
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if len(env) > 0 || len(secrets) > 0 {
+		// secrets are applied last so they can't be overridden by regular variables
+		cmd.Env = append(os.Environ(), EnvList(env)...)
+		cmd.Env = append(cmd.Env, EnvList(secrets)...)
+	}
+
+	if cmdErr := cmd.Start(); cmdErr != nil {
+		a.Logger.Debugln(cmdErr)
+		discardOutput(outb, errb)
+		return "", cmdErr.Error(), 65, nil, cmdErr
+	}
+
+	done := make(chan struct{})
+	go func(pid int) {
+		select {
+		case <-ctx.Done():
+			_ = syscall.Kill(-pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}(cmd.Process.Pid)
+
+	cmdErr := cmd.Wait()
+	close(done)
+	closeOutput()
+
+	stdout = outb.String()
+	stderr = errb.String()
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		stderr = fmt.Sprintf("%s\nScript timed out after %d seconds", stderr, timeout)
+		exitcode = 98
+		a.Logger.Debugln("Script check timeout:", ctx.Err())
+	case errors.As(cmdErr, &exitErr):
+		exitcode = exitErr.ExitCode()
+	case cmdErr != nil:
+		exitcode = 1
+	}
+	artifacts = a.outputArtifacts(outb, errb)
+	return stdout, stderr, exitcode, artifacts, nil
+}
+
+// runPlatformCheck runs the check types only available on Linux
+// Returns false if the check type is unknown or not supported on Linux
+func (a *Agent) runPlatformCheck(ctx context.Context, check rmm.Check, r *resty.Client) bool {
+	switch check.CheckType {
+	case CHECK_TYPE_RAID:
+		a.RaidCheck(ctx, check, r)
+	case CHECK_TYPE_SENSORS:
+		a.SensorsCheck(ctx, check, r)
+	case CHECK_TYPE_SYSTEMD:
+		a.SystemdCheck(ctx, check, r)
+	default:
+		return false
+	}
+	return true
+}
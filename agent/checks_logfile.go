@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const (
+	// Maximum number of bytes read per run, the rest is read by the next runs
+	LOGFILE_MAX_READ = 32 * 1024 * 1024
+	// Maximum number of matching lines reported, and their maximum length
+	LOGFILE_MAX_LINES       = 50
+	LOGFILE_MAX_LINE_LENGTH = 1024
+	// Number of bytes at the beginning of the file kept to detect a reused file identity
+	LOGFILE_HEAD_SIZE = 64
+)
+
+// LogFileState where a logfile check stopped reading
+type LogFileState struct {
+	Path     string `json:"path"`
+	Identity string `json:"identity"`
+	Offset   int64  `json:"offset"`
+	Head     []byte `json:"head"`
+}
+
+// LogFileResult lines read and matched during a logfile check run
+type LogFileResult struct {
+	Path       string   `json:"path"`
+	LinesRead  int      `json:"lines_read"`
+	MatchCount int      `json:"match_count"`
+	Matches    []string `json:"matches"`
+	Rotated    bool     `json:"rotated"`
+	Truncated  bool     `json:"truncated"`
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	budget  int64
+}
+
+// LogFileCheck matches the lines appended to a log file since the previous run
+func (a *Agent) LogFileCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	stateName := fmt.Sprintf("logfile-%d.json", data.CheckPK)
+	var state LogFileState
+	found, err := a.LoadCheckState(stateName, &state)
+	if err != nil {
+		a.Logger.Debugln("Logfile check state:", err)
+		found = false
+	}
+
+	result, state, err := ScanLogFile(data, state, found)
+	if err != nil {
+		a.Logger.Debugln("Logfile check", data.Path, err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	payload["result"] = result
+	payload["status"], payload["severity"] = LogFileStatus(result, data)
+
+	// The offset only moves forward once the matches have been reported
+	if err := a.sendCheckResult(ctx, data, payload, r); err != nil {
+		return
+	}
+	if err := a.SaveCheckState(stateName, state); err != nil {
+		a.Logger.Errorln("Unable to save logfile check state:", err)
+	}
+}
+
+// ScanLogFile reads the lines appended since the saved state and returns the new state
+// A rotated file is detected by its identity: the rest of the previous file is read if it can be found
+// next to the current one, then the current file is read from the start.
+// A file that is smaller than the offset or whose beginning changed is read from the start.
+// Without a saved state, reading starts at the end of the file unless from_start is set.
+func ScanLogFile(data rmm.Check, state LogFileState, found bool) (LogFileResult, LogFileState, error) {
+	result := LogFileResult{Path: data.Path, Matches: make([]string, 0), budget: LOGFILE_MAX_READ}
+
+	var err error
+	result.include, result.exclude, err = compilePatterns(data.IncludePatterns, data.ExcludePatterns)
+	if err != nil {
+		return result, state, err
+	}
+
+	f, err := os.Open(data.Path)
+	if err != nil {
+		return result, state, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return result, state, err
+	}
+	id, err := fileIdentity(f)
+	if err != nil {
+		return result, state, err
+	}
+	head := make([]byte, LOGFILE_HEAD_SIZE)
+	n, _ := f.ReadAt(head, 0)
+	head = head[:n]
+
+	newState := LogFileState{Path: data.Path, Identity: id, Head: head}
+
+	switch {
+	case !found || state.Path != data.Path:
+		if !data.FromStart {
+			newState.Offset = fi.Size()
+			return result, newState, nil
+		}
+	case state.Identity != id:
+		result.Rotated = true
+		if old := findRotatedLog(data.Path, state.Identity); old != nil {
+			result.readLines(old, state.Offset, true)
+			old.Close()
+		}
+	case fi.Size() < state.Offset || !sameHead(state.Head, head):
+		// truncated or rewritten, including a new file reusing the identity of a deleted one
+		result.Truncated = true
+	default:
+		newState.Offset = state.Offset
+	}
+
+	newState.Offset, err = result.readLines(f, newState.Offset, false)
+	return result, newState, err
+}
+
+// LogFileStatus compares the number of matches to the check's thresholds
+// Without thresholds, any match fails the check
+func LogFileStatus(result LogFileResult, data rmm.Check) (status, severity string) {
+	errThreshold := data.ErrorThreshold
+	if errThreshold <= 0 && data.WarningThreshold <= 0 {
+		errThreshold = 1
+	}
+	switch {
+	case errThreshold > 0 && result.MatchCount >= errThreshold:
+		return "failing", "error"
+	case data.WarningThreshold > 0 && result.MatchCount >= data.WarningThreshold:
+		return "failing", "warning"
+	}
+	return "passing", ""
+}
+
+// readLines matches the lines from offset and returns the offset following the last complete line
+// When final is set, a last line without a newline is read as well
+func (lr *LogFileResult) readLines(f *os.File, offset int64, final bool) (int64, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	reader := bufio.NewReader(f)
+	for lr.budget > 0 {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && (err != io.EOF || !final || len(line) == 0) {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		offset += int64(len(line))
+		lr.budget -= int64(len(line))
+		lr.match(string(bytes.TrimRight(line, "\r\n")))
+	}
+	return offset, nil
+}
+
+func (lr *LogFileResult) match(line string) {
+	lr.LinesRead++
+	if !matchPatterns(line, lr.include, lr.exclude) {
+		return
+	}
+
+	lr.MatchCount++
+	if len(lr.Matches) < LOGFILE_MAX_LINES {
+		if len(line) > LOGFILE_MAX_LINE_LENGTH {
+			line = line[:LOGFILE_MAX_LINE_LENGTH]
+		}
+		lr.Matches = append(lr.Matches, strings.ToValidUTF8(line, ""))
+	}
+}
+
+// findRotatedLog looks for the previous log file next to the current one, e.g. app.log.1
+func findRotatedLog(path, identity string) *os.File {
+	if identity == "" {
+		return nil
+	}
+	candidates, _ := filepath.Glob(path + "*")
+	for _, c := range candidates {
+		if c == path {
+			continue
+		}
+		f, err := os.Open(c)
+		if err != nil {
+			continue
+		}
+		if id, err := fileIdentity(f); err == nil && id == identity {
+			return f
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// sameHead returns true when one head is the beginning of the other, as a file's head grows until it's full
+func sameHead(a, b []byte) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return bytes.Equal(a, b[:len(a)])
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func TestScanLogFile(t *testing.T) {
+	appendFile := func(t *testing.T, path, content string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		// change is applied to the file after the first run saved its state
+		change        func(t *testing.T, path string)
+		wantMatches   []string
+		wantRotated   bool
+		wantTruncated bool
+	}{
+		{
+			name: "resume from saved offset",
+			change: func(t *testing.T, path string) {
+				appendFile(t, path, "ERROR second\ninfo third\nERROR partial")
+			},
+			wantMatches: []string{"ERROR second"},
+		},
+		{
+			name: "rotated to a new file",
+			change: func(t *testing.T, path string) {
+				appendFile(t, path, "ERROR before rotation\n")
+				if err := os.Rename(path, path+".1"); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path, "ERROR after rotation\n")
+			},
+			wantMatches: []string{"ERROR before rotation", "ERROR after rotation"},
+			wantRotated: true,
+		},
+		{
+			name: "rotated, previous file gone",
+			change: func(t *testing.T, path string) {
+				// replaced by a file created while the old one existed, so it has another inode
+				appendFile(t, path+".new", "ERROR new file\n")
+				if err := os.Rename(path+".new", path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantMatches: []string{"ERROR new file"},
+			wantRotated: true,
+		},
+		{
+			name: "truncated in place",
+			change: func(t *testing.T, path string) {
+				if err := os.Truncate(path, 0); err != nil {
+					t.Fatal(err)
+				}
+				appendFile(t, path, "ERROR x\n")
+			},
+			wantMatches:   []string{"ERROR x"},
+			wantTruncated: true,
+		},
+		{
+			name: "rewritten with a different beginning",
+			change: func(t *testing.T, path string) {
+				f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteAt([]byte("ERROR rewritten line 1\n"), 0)
+				f.Close()
+				appendFile(t, path, "ERROR appended\n")
+			},
+			wantMatches:   []string{"ERROR rewritten line 1", "ERROR appended"},
+			wantTruncated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.log")
+			appendFile(t, path, "ERROR existing line that is long enough\n")
+			data := rmm.Check{Path: path, IncludePatterns: []string{"ERROR"}}
+
+			// The first run starts at the end of the file
+			result, state, err := ScanLogFile(data, LogFileState{}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.LinesRead != 0 || state.Offset == 0 {
+				t.Fatalf("first run read %d lines, offset %d", result.LinesRead, state.Offset)
+			}
+
+			tt.change(t, path)
+			result, _, err = ScanLogFile(data, state, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(result.Matches, "|"); got != strings.Join(tt.wantMatches, "|") {
+				t.Errorf("matches = %q, want %q", result.Matches, tt.wantMatches)
+			}
+			if result.Rotated != tt.wantRotated || result.Truncated != tt.wantTruncated {
+				t.Errorf("rotated/truncated = %v/%v, want %v/%v", result.Rotated, result.Truncated, tt.wantRotated, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestScanLogFileFromStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("ERROR one\ninfo\nERROR two\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data := rmm.Check{Path: path, IncludePatterns: []string{"ERROR"}, FromStart: true}
+
+	result, state, err := ScanLogFile(data, LogFileState{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MatchCount != 2 || result.LinesRead != 3 || state.Offset != 25 {
+		t.Errorf("result = %+v, offset %d", result, state.Offset)
+	}
+
+	// Nothing new since the saved offset
+	result, state2, err := ScanLogFile(data, state, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LinesRead != 0 || state2.Offset != state.Offset {
+		t.Errorf("second run read %d lines, offset %d, want none from %d", result.LinesRead, state2.Offset, state.Offset)
+	}
+}
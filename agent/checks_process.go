@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	ps "github.com/elastic/go-sysinfo"
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+	gops "github.com/shirou/gopsutil/v3/process"
+)
+
+// CPU usage of matched processes is measured over this period
+const PROC_CHECK_CPU_SAMPLE = 2 * time.Second
+
+// ProcessMatch a process matched by a process check
+type ProcessMatch struct {
+	Pid     int      `json:"pid"`
+	Name    string   `json:"name"`
+	Exe     string   `json:"exe"`
+	CPU     *float64 `json:"cpu_percent"` // 100 is one full core, null when it couldn't be measured
+	RSSMB   float64  `json:"rss_mb"`
+	cmdline string
+	cpuTime float64
+}
+
+// ProcessCheck verifies the number and resource usage of matching processes
+func (a *Agent) ProcessCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	matches, err := FindProcesses(ctx, data)
+	if err != nil {
+		a.Logger.Debugln("Process check:", err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	assertions := ProcessAssertions(matches, data)
+	pids := make([]int, 0, len(matches))
+	for _, m := range matches {
+		pids = append(pids, m.Pid)
+	}
+	payload["pids"] = pids
+	payload["processes"] = matches
+	payload["assertions"] = assertions
+	payload["status"] = assertionsStatus(nil, assertions)
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// FindProcesses returns the processes matching the check's name, exe path and cmdline regex
+// Every criteria that is set must match
+func FindProcesses(ctx context.Context, data rmm.Check) ([]ProcessMatch, error) {
+	if data.ProcessName == "" && data.ProcessExe == "" && data.CmdlineRegex == "" {
+		return nil, fmt.Errorf("process check requires a process name, exe path or cmdline regex")
+	}
+
+	var cmdline *regexp.Regexp
+	if data.CmdlineRegex != "" {
+		re, err := regexp.Compile(data.CmdlineRegex)
+		if err != nil {
+			return nil, fmt.Errorf("cmdline_regex: %s", err)
+		}
+		cmdline = re
+	}
+
+	procs, err := ps.Processes()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]ProcessMatch, 0)
+	for _, process := range procs {
+		p, err := process.Info()
+		if err != nil || p.PID == 0 {
+			continue
+		}
+
+		m := ProcessMatch{Pid: p.PID, Name: p.Name, Exe: p.Exe, cmdline: strings.Join(p.Args, " ")}
+		if !m.matches(data, cmdline) {
+			continue
+		}
+		if mem, err := process.Memory(); err == nil {
+			m.RSSMB = float64(mem.Resident) / 1024 / 1024
+		}
+		matches = append(matches, m)
+	}
+
+	if err := sampleCPU(ctx, matches); err != nil {
+		return nil, fmt.Errorf("cpu sample: %s", err)
+	}
+	return matches, nil
+}
+
+func (m ProcessMatch) matches(data rmm.Check, cmdline *regexp.Regexp) bool {
+	if data.ProcessName != "" {
+		name := strings.TrimSuffix(strings.ToLower(m.Name), ".exe")
+		if name != strings.TrimSuffix(strings.ToLower(data.ProcessName), ".exe") {
+			return false
+		}
+	}
+	if data.ProcessExe != "" && !strings.EqualFold(filepath.Clean(m.Exe), filepath.Clean(data.ProcessExe)) {
+		return false
+	}
+	if cmdline != nil && !cmdline.MatchString(m.cmdline) {
+		return false
+	}
+	return true
+}
+
+// sampleCPU measures the CPU usage of the processes over PROC_CHECK_CPU_SAMPLE
+// It fails when ctx is done before the end of the sample. The usage of a process whose
+// CPU times can't be read is left unknown.
+func sampleCPU(ctx context.Context, matches []ProcessMatch) error {
+	if len(matches) == 0 {
+		return nil
+	}
+
+	cpuTime := func(pid int) float64 {
+		proc, err := gops.NewProcess(int32(pid))
+		if err != nil {
+			return -1
+		}
+		t, err := proc.Times()
+		if err != nil {
+			return -1
+		}
+		return t.User + t.System
+	}
+
+	start := time.Now()
+	for i := range matches {
+		matches[i].cpuTime = cpuTime(matches[i].Pid)
+	}
+	if !sleepContext(ctx, PROC_CHECK_CPU_SAMPLE) {
+		return ctx.Err()
+	}
+	elapsed := time.Since(start).Seconds()
+
+	for i := range matches {
+		end := cpuTime(matches[i].Pid)
+		if matches[i].cpuTime < 0 || end < 0 {
+			continue
+		}
+		usage := (end - matches[i].cpuTime) / elapsed * 100
+		matches[i].CPU = &usage
+	}
+	return nil
+}
+
+// ProcessAssertions checks the instance count and the resource usage of every matched process
+// At least one instance is required unless min_count is set
+func ProcessAssertions(matches []ProcessMatch, data rmm.Check) []CheckAssertion {
+	min := 1
+	if data.MinCount != nil {
+		min = *data.MinCount
+	}
+
+	count := CheckAssertion{Name: "count", Passed: len(matches) >= min}
+	if data.MaxCount != nil && len(matches) > *data.MaxCount {
+		count.Passed = false
+	}
+	count.Message = fmt.Sprintf("%d matching processes", len(matches))
+	if !count.Passed {
+		if data.MaxCount != nil {
+			count.Message += fmt.Sprintf(", expected %d to %d", min, *data.MaxCount)
+		} else {
+			count.Message += fmt.Sprintf(", expected at least %d", min)
+		}
+	}
+	assertions := []CheckAssertion{count}
+
+	for _, m := range matches {
+		if data.MaxCPUPercent > 0 {
+			cpu := CheckAssertion{Name: fmt.Sprintf("cpu:%d", m.Pid)}
+			if m.CPU == nil {
+				cpu.Message = fmt.Sprintf("%s (%d) cpu unknown, max %.1f%%", m.Name, m.Pid, data.MaxCPUPercent)
+			} else {
+				cpu.Passed = *m.CPU <= data.MaxCPUPercent
+				cpu.Message = fmt.Sprintf("%s (%d) cpu %.1f%%, max %.1f%%", m.Name, m.Pid, *m.CPU, data.MaxCPUPercent)
+			}
+			assertions = append(assertions, cpu)
+		}
+		if data.MaxRSSMB > 0 {
+			assertions = append(assertions, CheckAssertion{
+				Name:    fmt.Sprintf("rss:%d", m.Pid),
+				Passed:  m.RSSMB <= float64(data.MaxRSSMB),
+				Message: fmt.Sprintf("%s (%d) rss %.1f MB, max %d MB", m.Name, m.Pid, m.RSSMB, data.MaxRSSMB),
+			})
+		}
+	}
+	return assertions
+}
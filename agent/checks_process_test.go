@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func TestSampleCPUCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	matches := []ProcessMatch{{Pid: os.Getpid()}}
+	if err := sampleCPU(ctx, matches); err == nil {
+		t.Fatal("sampleCPU() with a cancelled context succeeded")
+	}
+	if matches[0].CPU != nil {
+		t.Errorf("CPU = %v, want unknown", *matches[0].CPU)
+	}
+}
+
+func TestProcessAssertionsCPU(t *testing.T) {
+	busy, idle := 95.0, 1.0
+	matches := []ProcessMatch{{Pid: 1, CPU: &busy}, {Pid: 2, CPU: &idle}, {Pid: 3}}
+	assertions := ProcessAssertions(matches, rmm.Check{MaxCPUPercent: 50})
+
+	want := map[string]bool{"count": true, "cpu:1": false, "cpu:2": true, "cpu:3": false}
+	if len(assertions) != len(want) {
+		t.Fatalf("assertions = %+v", assertions)
+	}
+	for _, a := range assertions {
+		if a.Passed != want[a.Name] {
+			t.Errorf("%s passed = %v, want %v (%s)", a.Name, a.Passed, want[a.Name], a.Message)
+		}
+	}
+}
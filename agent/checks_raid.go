@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const MDSTAT_PATH = "/proc/mdstat"
+
+var (
+	mdArrayRe  = regexp.MustCompile(`^(md\S*)\s*:\s*(\S+)\s*(.*)$`)
+	mdStatusRe = regexp.MustCompile(`\[(\d+)/(\d+)\]\s+\[([U_]+)\]`)
+	mdSyncRe   = regexp.MustCompile(`(resync|recovery|reshape|check|repair)\s*=\s*([0-9.]+)%`)
+	mdDelayRe  = regexp.MustCompile(`(resync|recovery|reshape|check|repair)\s*=\s*(DELAYED|PENDING)`)
+)
+
+// MDArray a Linux software RAID array from /proc/mdstat
+type MDArray struct {
+	Name        string   `json:"name"`
+	State       string   `json:"state"` // active, inactive
+	ReadOnly    bool     `json:"read_only"`
+	Level       string   `json:"level"`
+	Devices     []string `json:"devices"`
+	Failed      []string `json:"failed"`
+	Spares      []string `json:"spares"`
+	Total       int      `json:"total"`  // devices the array should have
+	Active      int      `json:"active"` // devices in sync
+	Status      string   `json:"status"` // e.g. UU_
+	Degraded    bool     `json:"degraded"`
+	Sync        string   `json:"sync,omitempty"` // resync, recovery, reshape, check or repair in progress
+	SyncPercent float64  `json:"sync_percent,omitempty"`
+	SyncPending bool     `json:"sync_pending,omitempty"` // delayed or pending
+}
+
+// RaidCheck reports degraded, failed and rebuilding software RAID arrays, Linux only
+// When a device is set, only the array with that name is evaluated.
+func (a *Agent) RaidCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	arrays, err := GetMDArrays(data.Device)
+	if err != nil {
+		a.Logger.Debugln("Raid check:", err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	assertions, severity := RaidAssertions(arrays)
+	payload["arrays"] = arrays
+	payload["assertions"] = assertions
+	payload["status"] = assertionsStatus(nil, assertions)
+	if severity != "" {
+		payload["severity"] = severity
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// GetMDArrays reads /proc/mdstat, keeping only the named array when name is set
+func GetMDArrays(name string) ([]MDArray, error) {
+	content, err := os.ReadFile(MDSTAT_PATH)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("no software RAID support (" + MDSTAT_PATH + " not found)")
+		}
+		return nil, err
+	}
+
+	arrays := ParseMDStat(string(content))
+	if name != "" {
+		name = strings.TrimPrefix(name, "/dev/")
+		for _, array := range arrays {
+			if array.Name == name {
+				return []MDArray{array}, nil
+			}
+		}
+		return nil, fmt.Errorf("array %s not found", name)
+	}
+	if len(arrays) == 0 {
+		return nil, errors.New("no software RAID arrays")
+	}
+	return arrays, nil
+}
+
+// ParseMDStat parses the content of /proc/mdstat
+//
+//	md1 : active raid1 sdb2[1](F) sda2[0]
+//	      976105472 blocks super 1.2 [2/1] [U_]
+//	      [=>...................]  recovery =  8.5% (83049216/976105472) finish=77.2min speed=192672K/sec
+func ParseMDStat(content string) []MDArray {
+	arrays := make([]MDArray, 0)
+	var cur *MDArray
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := mdArrayRe.FindStringSubmatch(line); m != nil {
+			arrays = append(arrays, MDArray{Name: m[1], State: m[2], Devices: make([]string, 0), Failed: make([]string, 0), Spares: make([]string, 0)})
+			cur = &arrays[len(arrays)-1]
+			parseMDDevices(cur, strings.Fields(m[3]))
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			cur = nil
+			continue
+		}
+		if m := mdStatusRe.FindStringSubmatch(line); m != nil {
+			cur.Total, _ = strconv.Atoi(m[1])
+			cur.Active, _ = strconv.Atoi(m[2])
+			cur.Status = m[3]
+			cur.Degraded = cur.Active < cur.Total || strings.Contains(cur.Status, "_")
+		}
+		if m := mdSyncRe.FindStringSubmatch(line); m != nil {
+			cur.Sync = m[1]
+			cur.SyncPercent, _ = strconv.ParseFloat(m[2], 64)
+		} else if m := mdDelayRe.FindStringSubmatch(line); m != nil {
+			cur.Sync = m[1]
+			cur.SyncPending = true
+		}
+	}
+	return arrays
+}
+
+// parseMDDevices reads the optional read-only flag, the level and the member devices, e.g. sda1[0](F)
+func parseMDDevices(array *MDArray, fields []string) {
+	for _, f := range fields {
+		switch {
+		case f == "(read-only)" || f == "(auto-read-only)":
+			array.ReadOnly = true
+		case !strings.Contains(f, "[") && array.Level == "" && array.State != "inactive":
+			array.Level = f
+		default:
+			dev := f
+			if i := strings.Index(f, "["); i >= 0 {
+				dev = f[:i]
+			}
+			array.Devices = append(array.Devices, dev)
+			if strings.HasSuffix(f, "(F)") {
+				array.Failed = append(array.Failed, dev)
+			} else if strings.HasSuffix(f, "(S)") {
+				array.Spares = append(array.Spares, dev)
+			}
+		}
+	}
+}
+
+// RaidAssertions fails inactive arrays, degraded arrays and arrays with failed devices
+// A rebuild of a degraded array is an error until it completes, other sync operations are reported only.
+func RaidAssertions(arrays []MDArray) ([]CheckAssertion, string) {
+	assertions := make([]CheckAssertion, 0)
+	severity := ""
+	for _, array := range arrays {
+		assertion := CheckAssertion{Name: array.Name, Passed: true}
+		switch {
+		case array.State == "inactive":
+			assertion.Passed = false
+			assertion.Message = array.Name + " is inactive"
+		case array.Degraded:
+			assertion.Passed = false
+			assertion.Message = fmt.Sprintf("%s is degraded [%d/%d] [%s]", array.Name, array.Total, array.Active, array.Status)
+			assertion.Message += syncMessage(array)
+		case len(array.Failed) > 0:
+			assertion.Passed = false
+			assertion.Message = fmt.Sprintf("%s has failed devices: %s", array.Name, strings.Join(array.Failed, ", "))
+		default:
+			assertion.Message = fmt.Sprintf("%s %s [%s]", array.Name, array.Level, array.Status)
+			assertion.Message += syncMessage(array)
+		}
+		if !assertion.Passed {
+			severity = "error"
+		}
+		assertions = append(assertions, assertion)
+	}
+	return assertions, severity
+}
+
+func syncMessage(array MDArray) string {
+	switch {
+	case array.Sync == "":
+		return ""
+	case array.SyncPending:
+		return fmt.Sprintf(", %s pending", array.Sync)
+	}
+	return fmt.Sprintf(", %s %.1f%%", array.Sync, array.SyncPercent)
+}
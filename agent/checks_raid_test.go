@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseMDStat(t *testing.T) {
+	content, err := os.ReadFile("testdata/mdstat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	none := []string{}
+	want := []MDArray{
+		{Name: "md0", State: "active", Level: "raid1", Devices: []string{"sdb1", "sda1"}, Failed: none, Spares: none,
+			Total: 2, Active: 2, Status: "UU"},
+		{Name: "md1", State: "active", Level: "raid1", Devices: []string{"sdb2", "sda2"}, Failed: []string{"sdb2"}, Spares: none,
+			Total: 2, Active: 1, Status: "U_", Degraded: true, Sync: "recovery", SyncPercent: 8.5},
+		{Name: "md2", State: "active", Level: "raid5", Devices: []string{"sdf1", "sde1", "sdd1", "sdg1"}, Failed: none, Spares: []string{"sdg1"},
+			Total: 3, Active: 3, Status: "UUU", Sync: "check", SyncPercent: 12.3},
+		{Name: "md3", State: "active", ReadOnly: true, Level: "raid1", Devices: []string{"sdh1", "sdi1"}, Failed: none, Spares: none,
+			Total: 2, Active: 2, Status: "UU", Sync: "resync", SyncPending: true},
+		{Name: "md127", State: "inactive", Devices: []string{"sdj1"}, Failed: none, Spares: []string{"sdj1"}},
+	}
+
+	arrays := ParseMDStat(string(content))
+	if len(arrays) != len(want) {
+		t.Fatalf("ParseMDStat() returned %d arrays, want %d", len(arrays), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(arrays[i], want[i]) {
+			t.Errorf("ParseMDStat() array %d = %+v, want %+v", i, arrays[i], want[i])
+		}
+	}
+
+	if got := ParseMDStat("Personalities : [raid1]\nunused devices: <none>\n"); len(got) != 0 {
+		t.Errorf("ParseMDStat() without arrays = %+v", got)
+	}
+}
+
+func TestRaidAssertions(t *testing.T) {
+	content, err := os.ReadFile("testdata/mdstat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrays := ParseMDStat(string(content))
+	// a failed member that was already replaced by a spare
+	arrays = append(arrays, MDArray{Name: "md4", State: "active", Level: "raid1", Devices: []string{"sdk1", "sdl1", "sdm1"},
+		Failed: []string{"sdm1"}, Total: 2, Active: 2, Status: "UU"})
+
+	want := []CheckAssertion{
+		{Name: "md0", Passed: true, Message: "md0 raid1 [UU]"},
+		{Name: "md1", Passed: false, Message: "md1 is degraded [2/1] [U_], recovery 8.5%"},
+		{Name: "md2", Passed: true, Message: "md2 raid5 [UUU], check 12.3%"},
+		{Name: "md3", Passed: true, Message: "md3 raid1 [UU], resync pending"},
+		{Name: "md127", Passed: false, Message: "md127 is inactive"},
+		{Name: "md4", Passed: false, Message: "md4 has failed devices: sdm1"},
+	}
+	assertions, severity := RaidAssertions(arrays)
+	if !reflect.DeepEqual(assertions, want) {
+		t.Errorf("RaidAssertions() = %+v, want %+v", assertions, want)
+	}
+	if severity != "error" {
+		t.Errorf("RaidAssertions() severity = %q, want error", severity)
+	}
+
+	assertions, severity = RaidAssertions(arrays[:1])
+	if !assertions[0].Passed || severity != "" {
+		t.Errorf("RaidAssertions() of a healthy array = %+v, %q", assertions, severity)
+	}
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const HWMON_PATH = "/sys/class/hwmon"
+
+var hwmonInputRe = regexp.MustCompile(`^(temp|fan)(\d+)_input$`)
+
+// SensorReading a temperature in °C or a fan speed in RPM
+// Max and Crit are the chip's temperature limits, Min its minimum fan speed, when it reports them
+type SensorReading struct {
+	Chip  string   `json:"chip"`
+	Label string   `json:"label"`
+	Kind  string   `json:"kind"` // temperature or fan
+	Value float64  `json:"value"`
+	Max   *float64 `json:"max,omitempty"`
+	Crit  *float64 `json:"crit,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+}
+
+// SensorsCheck evaluates the temperatures and fan speeds reported by the hardware monitoring chips, Linux only
+// When a device is set, only the chips with that name are evaluated, e.g. coretemp.
+func (a *Agent) SensorsCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	readings, err := ReadHwmon(HWMON_PATH, data.Device)
+	if err == nil && len(readings) == 0 {
+		err = errors.New("no temperature or fan sensors found")
+	}
+	if err != nil {
+		a.Logger.Debugln("Sensors check:", err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	assertions, severity := SensorAssertions(readings, data)
+	payload["sensors"] = readings
+	payload["assertions"] = assertions
+	payload["status"] = assertionsStatus(nil, assertions)
+	if severity != "" {
+		payload["severity"] = severity
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// ReadHwmon reads the temperature and fan inputs of every chip under root, e.g. /sys/class/hwmon
+// Chips are filtered by name when chip is set. Inputs that can't be read, e.g. a disconnected fan, are skipped.
+func ReadHwmon(root, chip string) ([]SensorReading, error) {
+	dirs, err := filepath.Glob(filepath.Join(root, "hwmon*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		if _, err := os.Stat(root); err != nil {
+			return nil, errors.New("no hardware monitoring support (" + root + " not found)")
+		}
+	}
+	sort.Strings(dirs)
+
+	readings := make([]SensorReading, 0)
+	for _, dir := range dirs {
+		name := readSysString(filepath.Join(dir, "name"))
+		if name == "" {
+			name = filepath.Base(dir)
+		}
+		if chip != "" && name != chip {
+			continue
+		}
+
+		inputs, _ := filepath.Glob(filepath.Join(dir, "*_input"))
+		sort.Strings(inputs)
+		for _, input := range inputs {
+			m := hwmonInputRe.FindStringSubmatch(filepath.Base(input))
+			if m == nil {
+				continue
+			}
+			value, ok := readSysNumber(input)
+			if !ok {
+				continue
+			}
+
+			prefix := filepath.Join(dir, m[1]+m[2])
+			reading := SensorReading{Chip: name, Label: readSysString(prefix + "_label")}
+			if reading.Label == "" {
+				reading.Label = m[1] + m[2]
+			}
+			if m[1] == "temp" {
+				// millidegrees Celsius
+				reading.Kind = "temperature"
+				reading.Value = value / 1000
+				reading.Max = sysMilli(prefix + "_max")
+				reading.Crit = sysMilli(prefix + "_crit")
+			} else {
+				reading.Kind = "fan"
+				reading.Value = value
+				if min, ok := readSysNumber(prefix + "_min"); ok && min > 0 {
+					reading.Min = &min
+				}
+			}
+			readings = append(readings, reading)
+		}
+	}
+	return readings, nil
+}
+
+// SensorAssertions compares temperatures to the check's thresholds and to the chip's critical limit,
+// and fan speeds to min_fan_rpm or to the chip's minimum
+func SensorAssertions(readings []SensorReading, data rmm.Check) ([]CheckAssertion, string) {
+	assertions := make([]CheckAssertion, 0)
+	severity := ""
+	for _, s := range readings {
+		assertion := CheckAssertion{Name: s.Chip + " " + s.Label, Passed: true}
+		sev := ""
+		if s.Kind == "temperature" {
+			assertion.Message = fmt.Sprintf("%.1f°C", s.Value)
+			switch {
+			case s.Crit != nil && *s.Crit > 0 && s.Value >= *s.Crit:
+				sev = "error"
+				assertion.Message += fmt.Sprintf(", critical %.1f", *s.Crit)
+			case data.ErrorThreshold > 0 && s.Value >= float64(data.ErrorThreshold):
+				sev = "error"
+				assertion.Message += fmt.Sprintf(", max %d", data.ErrorThreshold)
+			case data.WarningThreshold > 0 && s.Value >= float64(data.WarningThreshold):
+				sev = "warning"
+				assertion.Message += fmt.Sprintf(", max %d", data.WarningThreshold)
+			}
+		} else {
+			assertion.Message = fmt.Sprintf("%.0f RPM", s.Value)
+			min := s.Min
+			if data.MinFanRPM > 0 {
+				v := float64(data.MinFanRPM)
+				min = &v
+			}
+			if min != nil && s.Value < *min {
+				sev = "error"
+				assertion.Message += fmt.Sprintf(", min %.0f", *min)
+			}
+		}
+		if sev != "" {
+			assertion.Passed = false
+			severity = worseSeverity(severity, sev)
+		}
+		assertions = append(assertions, assertion)
+	}
+	return assertions, severity
+}
+
+func readSysString(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func readSysNumber(path string) (float64, bool) {
+	v, err := strconv.ParseFloat(readSysString(path), 64)
+	return v, err == nil
+}
+
+// sysMilli reads a value in thousandths, nil when it isn't reported
+func sysMilli(path string) *float64 {
+	v, ok := readSysNumber(path)
+	if !ok {
+		return nil
+	}
+	v /= 1000
+	return &v
+}
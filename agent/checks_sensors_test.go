@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func TestReadHwmon(t *testing.T) {
+	readings, err := ReadHwmon("testdata/hwmon", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := func(v float64) *float64 { return &v }
+	want := []SensorReading{
+		{Chip: "coretemp", Label: "Package id 0", Kind: "temperature", Value: 52, Max: f(84), Crit: f(100)},
+		{Chip: "coretemp", Label: "Core 0", Kind: "temperature", Value: 101, Crit: f(100)},
+		{Chip: "nct6775", Label: "fan1", Kind: "fan", Value: 1250, Min: f(300)},
+		// a minimum of 0 means none is set; fan3 can't be read, in0 is a voltage
+		{Chip: "nct6775", Label: "fan2", Kind: "fan", Value: 0},
+		{Chip: "nvme", Label: "Composite", Kind: "temperature", Value: 38.85},
+	}
+	if !reflect.DeepEqual(readings, want) {
+		t.Errorf("ReadHwmon() = %+v, want %+v", readings, want)
+	}
+
+	readings, err = ReadHwmon("testdata/hwmon", "nct6775")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 2 {
+		t.Errorf("ReadHwmon() of nct6775 returned %d readings, want 2", len(readings))
+	}
+
+	if _, err := ReadHwmon("testdata/missing", ""); err == nil {
+		t.Error("ReadHwmon() without hwmon should fail")
+	}
+}
+
+func TestSensorAssertions(t *testing.T) {
+	readings, err := ReadHwmon("testdata/hwmon", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertions, severity := SensorAssertions(readings, rmm.Check{WarningThreshold: 50, ErrorThreshold: 90})
+	want := []CheckAssertion{
+		{Name: "coretemp Package id 0", Passed: false, Message: "52.0°C, max 50"},
+		{Name: "coretemp Core 0", Passed: false, Message: "101.0°C, critical 100.0"},
+		{Name: "nct6775 fan1", Passed: true, Message: "1250 RPM"},
+		{Name: "nct6775 fan2", Passed: true, Message: "0 RPM"},
+		{Name: "nvme Composite", Passed: true, Message: "38.9°C"},
+	}
+	if !reflect.DeepEqual(assertions, want) {
+		t.Errorf("SensorAssertions() = %+v, want %+v", assertions, want)
+	}
+	if severity != "error" {
+		t.Errorf("SensorAssertions() severity = %q, want error", severity)
+	}
+
+	// min_fan_rpm overrides the chip's minimum
+	assertions, severity = SensorAssertions(readings[2:4], rmm.Check{MinFanRPM: 1500})
+	for _, a := range assertions {
+		if a.Passed {
+			t.Errorf("SensorAssertions() %s passed below min_fan_rpm", a.Name)
+		}
+	}
+	if severity != "error" {
+		t.Errorf("SensorAssertions() severity = %q, want error", severity)
+	}
+
+	assertions, severity = SensorAssertions(readings[4:], rmm.Check{WarningThreshold: 35, ErrorThreshold: 70})
+	if assertions[0].Passed || severity != "warning" {
+		t.Errorf("SensorAssertions() = %+v, %q, want a warning", assertions, severity)
+	}
+}
@@ -0,0 +1,330 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const (
+	// Default timeout of a smart check, in seconds
+	SMART_CHECK_TIMEOUT = 60
+
+	// smartctl exit status bits: command line error and device open failure, the output is unusable
+	SMARTCTL_FATAL = 0x3
+)
+
+// ATA attributes whose raw value counts failing sectors
+var smartSectorAttributes = map[int]string{
+	5:   "reallocated sectors",
+	197: "pending sectors",
+	198: "offline uncorrectable sectors",
+}
+
+// SmartDevice health of a disk as reported by smartctl
+type SmartDevice struct {
+	Name         string           `json:"name"`
+	Type         string           `json:"type"`
+	Model        string           `json:"model"`
+	Serial       string           `json:"serial"`
+	Passed       *bool            `json:"passed"` // overall health self-assessment
+	Temperature  *int             `json:"temperature"`
+	PowerOnHours int              `json:"power_on_hours"`
+	Attributes   []SmartAttribute `json:"attributes,omitempty"`
+	NVMe         *SmartNVMeHealth `json:"nvme,omitempty"`
+	ExitStatus   int              `json:"exit_status"`
+	Error        string           `json:"error,omitempty"` // smartctl couldn't read the device
+}
+
+// SmartAttribute an ATA SMART attribute
+type SmartAttribute struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Value      int    `json:"value"`
+	Worst      int    `json:"worst"`
+	Thresh     int    `json:"thresh"`
+	Raw        int64  `json:"raw"`
+	WhenFailed string `json:"when_failed,omitempty"`
+}
+
+// SmartNVMeHealth the NVMe health information log
+type SmartNVMeHealth struct {
+	CriticalWarning         int   `json:"critical_warning"`
+	AvailableSpare          int   `json:"available_spare"`
+	AvailableSpareThreshold int   `json:"available_spare_threshold"`
+	PercentageUsed          int   `json:"percentage_used"`
+	MediaErrors             int64 `json:"media_errors"`
+}
+
+// smartctlOutput the parts of smartctl --json output used by the check
+type smartctlOutput struct {
+	Smartctl struct {
+		ExitStatus int `json:"exit_status"`
+		Messages   []struct {
+			String   string `json:"string"`
+			Severity string `json:"severity"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	Devices []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"devices"`
+	Device struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"device"`
+	ModelName    string `json:"model_name"`
+	SerialNumber string `json:"serial_number"`
+	SmartStatus  *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature *struct {
+		Current int `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime struct {
+		Hours int `json:"hours"`
+	} `json:"power_on_time"`
+	ATASmartAttributes *struct {
+		Table []struct {
+			ID         int    `json:"id"`
+			Name       string `json:"name"`
+			Value      int    `json:"value"`
+			Worst      int    `json:"worst"`
+			Thresh     int    `json:"thresh"`
+			WhenFailed string `json:"when_failed"`
+			Raw        struct {
+				Value int64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NVMeHealth *SmartNVMeHealth `json:"nvme_smart_health_information_log"`
+}
+
+// SmartCheck evaluates the health of a disk, or of every disk found by smartctl when no device is set
+func (a *Agent) SmartCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	devices, err := GetSmartDevices(ctx, data)
+	if err != nil {
+		a.Logger.Debugln("Smart check:", err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	assertions := make([]CheckAssertion, 0)
+	severity := ""
+	for _, dev := range devices {
+		devAssertions, devSeverity := SmartAssertions(dev, data)
+		assertions = append(assertions, devAssertions...)
+		severity = worseSeverity(severity, devSeverity)
+	}
+	payload["devices"] = devices
+	payload["assertions"] = assertions
+	payload["status"] = assertionsStatus(nil, assertions)
+	if severity != "" {
+		payload["severity"] = severity
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// GetSmartDevices runs smartctl on the check's device, or on the devices it finds
+// A device that can't be read is returned with its error, so the other devices are still evaluated.
+func GetSmartDevices(ctx context.Context, data rmm.Check) ([]SmartDevice, error) {
+	smartctl, err := findSmartctl()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout(data, SMART_CHECK_TIMEOUT))
+	defer cancel()
+
+	type target struct{ name, devType string }
+	targets := make([]target, 0)
+	if data.Device != "" {
+		targets = append(targets, target{name: data.Device})
+	} else {
+		out, _, err := CommandOutput(ctx, smartctl, "--scan-open", "--json")
+		if err != nil {
+			return nil, err
+		}
+		var scan smartctlOutput
+		if err := json.Unmarshal(out, &scan); err != nil {
+			return nil, fmt.Errorf("smartctl --scan-open: %s", err)
+		}
+		for _, d := range scan.Devices {
+			targets = append(targets, target{name: d.Name, devType: d.Type})
+		}
+		if len(targets) == 0 {
+			return nil, errors.New("smartctl found no devices")
+		}
+	}
+
+	devices := make([]SmartDevice, 0, len(targets))
+	for _, t := range targets {
+		args := []string{"--json", "--all"}
+		if t.devType != "" {
+			args = append(args, "--device", t.devType)
+		}
+		out, status, err := CommandOutput(ctx, smartctl, append(args, t.name)...)
+		if err != nil {
+			devices = append(devices, SmartDevice{Name: t.name, Type: t.devType, Error: err.Error()})
+			continue
+		}
+		dev, err := ParseSmartctl(out)
+		if err != nil {
+			devices = append(devices, SmartDevice{Name: t.name, Type: t.devType, ExitStatus: status, Error: err.Error()})
+			continue
+		}
+		if dev.Name == "" {
+			dev.Name = t.name
+		}
+		dev.ExitStatus = status
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// ParseSmartctl parses the output of smartctl --json --all
+// An error is returned when smartctl couldn't read the device.
+func ParseSmartctl(content []byte) (SmartDevice, error) {
+	var out smartctlOutput
+	if err := json.Unmarshal(content, &out); err != nil {
+		return SmartDevice{}, err
+	}
+	if out.Smartctl.ExitStatus&SMARTCTL_FATAL != 0 {
+		msg := fmt.Sprintf("smartctl exit status %d", out.Smartctl.ExitStatus)
+		for _, m := range out.Smartctl.Messages {
+			if m.Severity == "error" {
+				msg = m.String
+				break
+			}
+		}
+		return SmartDevice{}, errors.New(msg)
+	}
+
+	dev := SmartDevice{
+		Name:         out.Device.Name,
+		Type:         out.Device.Type,
+		Model:        out.ModelName,
+		Serial:       out.SerialNumber,
+		PowerOnHours: out.PowerOnTime.Hours,
+		NVMe:         out.NVMeHealth,
+		ExitStatus:   out.Smartctl.ExitStatus,
+	}
+	if out.SmartStatus != nil {
+		passed := out.SmartStatus.Passed
+		dev.Passed = &passed
+	}
+	if out.Temperature != nil {
+		temp := out.Temperature.Current
+		dev.Temperature = &temp
+	}
+	if out.ATASmartAttributes != nil {
+		for _, attr := range out.ATASmartAttributes.Table {
+			dev.Attributes = append(dev.Attributes, SmartAttribute{
+				ID:         attr.ID,
+				Name:       attr.Name,
+				Value:      attr.Value,
+				Worst:      attr.Worst,
+				Thresh:     attr.Thresh,
+				Raw:        attr.Raw.Value,
+				WhenFailed: attr.WhenFailed,
+			})
+		}
+	}
+	return dev, nil
+}
+
+// SmartAssertions evaluates a device's health, its attributes and its temperature against the check's thresholds
+// Unreadable devices, failed health, attributes at or below their threshold and NVMe critical warnings are errors,
+// failing sectors and media errors are warnings.
+func SmartAssertions(dev SmartDevice, data rmm.Check) ([]CheckAssertion, string) {
+	assertions := make([]CheckAssertion, 0)
+	severity := ""
+	add := func(name string, passed bool, sev, msg string) {
+		assertions = append(assertions, CheckAssertion{Name: dev.Name + " " + name, Passed: passed, Message: msg})
+		if !passed {
+			severity = worseSeverity(severity, sev)
+		}
+	}
+
+	if dev.Error != "" {
+		add("read", false, "error", dev.Error)
+		return assertions, severity
+	}
+
+	if dev.Passed != nil {
+		if *dev.Passed {
+			add("health", true, "", "SMART overall-health self-assessment passed")
+		} else {
+			add("health", false, "error", "SMART overall-health self-assessment failed")
+		}
+	}
+
+	for _, attr := range dev.Attributes {
+		if attr.WhenFailed != "" || (attr.Thresh > 0 && attr.Value <= attr.Thresh) {
+			add(attr.Name, false, "error", fmt.Sprintf("%s value %d, threshold %d", attr.Name, attr.Value, attr.Thresh))
+			continue
+		}
+		if what, ok := smartSectorAttributes[attr.ID]; ok {
+			add(attr.Name, attr.Raw == 0, "warning", fmt.Sprintf("%d %s", attr.Raw, what))
+		}
+	}
+
+	if n := dev.NVMe; n != nil {
+		add("critical_warning", n.CriticalWarning == 0, "error", fmt.Sprintf("critical warning 0x%02x", n.CriticalWarning))
+		add("available_spare", n.AvailableSpare >= n.AvailableSpareThreshold, "error",
+			fmt.Sprintf("available spare %d%%, threshold %d%%", n.AvailableSpare, n.AvailableSpareThreshold))
+		add("media_errors", n.MediaErrors == 0, "warning", fmt.Sprintf("%d media errors", n.MediaErrors))
+		add("percentage_used", n.PercentageUsed < 100, "warning", fmt.Sprintf("%d%% of rated endurance used", n.PercentageUsed))
+	}
+
+	if dev.Temperature != nil {
+		temp := *dev.Temperature
+		switch {
+		case data.ErrorThreshold > 0 && temp >= data.ErrorThreshold:
+			add("temperature", false, "error", fmt.Sprintf("%d°C, max %d", temp, data.ErrorThreshold))
+		case data.WarningThreshold > 0 && temp >= data.WarningThreshold:
+			add("temperature", false, "warning", fmt.Sprintf("%d°C, max %d", temp, data.WarningThreshold))
+		default:
+			add("temperature", true, "", fmt.Sprintf("%d°C", temp))
+		}
+	}
+	return assertions, severity
+}
+
+// findSmartctl looks for smartctl in the path, then in the default smartmontools folder on Windows
+func findSmartctl() (string, error) {
+	if path, err := exec.LookPath("smartctl"); err == nil {
+		return path, nil
+	}
+	if runtime.GOOS == "windows" {
+		path := filepath.Join(os.Getenv("ProgramFiles"), "smartmontools", "bin", "smartctl.exe")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("smartctl not found, smartmontools 7.0 or later is required")
+}
+
+// worseSeverity returns the more severe of two check severities
+func worseSeverity(a, b string) string {
+	rank := map[string]int{"": 0, "info": 1, "warning": 2, "error": 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
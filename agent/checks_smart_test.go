@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func readSmartFixture(t *testing.T, name string) SmartDevice {
+	t.Helper()
+	content, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := ParseSmartctl(content)
+	if err != nil {
+		t.Fatalf("ParseSmartctl(%s): %s", name, err)
+	}
+	return dev
+}
+
+func TestParseSmartctlATA(t *testing.T) {
+	dev := readSmartFixture(t, "smartctl-ata.json")
+	if dev.Name != "/dev/sda" || dev.Type != "sat" || dev.Model != "WDC WD40EFRX-68N32N0" || dev.Serial != "WD-WCC7K1234567" {
+		t.Errorf("ParseSmartctl() device = %s %s %s %s", dev.Name, dev.Type, dev.Model, dev.Serial)
+	}
+	if dev.Passed == nil || !*dev.Passed {
+		t.Error("ParseSmartctl() health should have passed")
+	}
+	if dev.Temperature == nil || *dev.Temperature != 37 {
+		t.Errorf("ParseSmartctl() temperature = %v, want 37", dev.Temperature)
+	}
+	// 64: the error log has entries, the output is still usable
+	if dev.PowerOnHours != 36151 || dev.ExitStatus != 64 || dev.NVMe != nil {
+		t.Errorf("ParseSmartctl() = %+v", dev)
+	}
+	if len(dev.Attributes) != 6 {
+		t.Fatalf("ParseSmartctl() returned %d attributes, want 6", len(dev.Attributes))
+	}
+	want := SmartAttribute{ID: 5, Name: "Reallocated_Sector_Ct", Value: 200, Worst: 200, Thresh: 140, Raw: 8}
+	if dev.Attributes[1] != want {
+		t.Errorf("ParseSmartctl() attribute = %+v, want %+v", dev.Attributes[1], want)
+	}
+}
+
+func TestParseSmartctlNVMe(t *testing.T) {
+	dev := readSmartFixture(t, "smartctl-nvme.json")
+	want := &SmartNVMeHealth{CriticalWarning: 4, AvailableSpare: 100, AvailableSpareThreshold: 10, PercentageUsed: 3}
+	if !reflect.DeepEqual(dev.NVMe, want) {
+		t.Errorf("ParseSmartctl() nvme = %+v, want %+v", dev.NVMe, want)
+	}
+	if dev.Passed == nil || *dev.Passed {
+		t.Error("ParseSmartctl() health should have failed")
+	}
+}
+
+func TestParseSmartctlOpenFailed(t *testing.T) {
+	content, err := os.ReadFile("testdata/smartctl-open-failed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseSmartctl(content)
+	if err == nil || err.Error() != "Smartctl open device: /dev/sdz failed: No such device" {
+		t.Errorf("ParseSmartctl() error = %v", err)
+	}
+}
+
+func TestSmartAssertions(t *testing.T) {
+	check := rmm.Check{WarningThreshold: 45, ErrorThreshold: 55}
+
+	assertions, severity := SmartAssertions(readSmartFixture(t, "smartctl-ata.json"), check)
+	want := []CheckAssertion{
+		{Name: "/dev/sda health", Passed: true, Message: "SMART overall-health self-assessment passed"},
+		{Name: "/dev/sda Reallocated_Sector_Ct", Passed: false, Message: "8 reallocated sectors"},
+		{Name: "/dev/sda Current_Pending_Sector", Passed: true, Message: "0 pending sectors"},
+		{Name: "/dev/sda Offline_Uncorrectable", Passed: true, Message: "0 offline uncorrectable sectors"},
+		{Name: "/dev/sda temperature", Passed: true, Message: "37°C"},
+	}
+	if !reflect.DeepEqual(assertions, want) {
+		t.Errorf("SmartAssertions() = %+v, want %+v", assertions, want)
+	}
+	if severity != "warning" {
+		t.Errorf("SmartAssertions() severity = %q, want warning", severity)
+	}
+
+	assertions, severity = SmartAssertions(readSmartFixture(t, "smartctl-nvme.json"), check)
+	failed := make([]string, 0)
+	for _, a := range assertions {
+		if !a.Passed {
+			failed = append(failed, a.Name)
+		}
+	}
+	wantFailed := []string{"/dev/nvme0 health", "/dev/nvme0 critical_warning", "/dev/nvme0 temperature"}
+	if !reflect.DeepEqual(failed, wantFailed) || severity != "error" {
+		t.Errorf("SmartAssertions() failed %v with %q, want %v with error", failed, severity, wantFailed)
+	}
+
+	assertions, severity = SmartAssertions(SmartDevice{Name: "/dev/sdz", Error: "No such device"}, check)
+	if len(assertions) != 1 || assertions[0].Passed || assertions[0].Name != "/dev/sdz read" || severity != "error" {
+		t.Errorf("SmartAssertions() of an unreadable device = %+v, %q", assertions, severity)
+	}
+}
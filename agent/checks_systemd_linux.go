@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+// Default timeout of the systemctl queries of a systemd check, in seconds
+const SYSTEMD_CHECK_TIMEOUT = 30
+
+// SystemdUnit a unit listed by systemctl list-units
+type SystemdUnit struct {
+	Name        string `json:"name"`
+	Load        string `json:"load"`
+	Active      string `json:"active"`
+	Sub         string `json:"sub"`
+	Description string `json:"description"`
+}
+
+// SystemdCheck fails when the system is degraded or when failed units match the check's patterns, Linux only
+// With restart_if_stopped, the failed units are restarted first.
+func (a *Agent) SystemdCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	include, exclude, err := compilePatterns(data.IncludePatterns, data.ExcludePatterns)
+	if err == nil {
+		_, err = exec.LookPath("systemctl")
+	}
+	if err != nil {
+		a.Logger.Debugln("Systemd check:", err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	state, failed, err := GetSystemdState(ctx, checkTimeout(data, SYSTEMD_CHECK_TIMEOUT))
+	if err == nil && data.RestartIfStopped && len(FilterUnits(failed, include, exclude)) > 0 {
+		restarts := make(map[string]ServiceRestart)
+		for _, unit := range FilterUnits(failed, include, exclude) {
+			restarts[unit.Name] = a.RestartUnit(ctx, unit.Name, SVC_CHECK_RESTART_ATTEMPTS)
+		}
+		payload["restart"] = restarts
+		state, failed, err = GetSystemdState(ctx, checkTimeout(data, SYSTEMD_CHECK_TIMEOUT))
+	}
+	if err != nil {
+		a.Logger.Debugln("Systemd check:", err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	matched := FilterUnits(failed, include, exclude)
+	payload["system_state"] = state
+	payload["failed_units"] = matched
+	payload["status"] = SystemdStatus(state, matched, len(include) > 0 || len(exclude) > 0)
+	if len(matched) > 0 {
+		names := make([]string, len(matched))
+		for i, unit := range matched {
+			names[i] = unit.Name
+		}
+		payload["more_info"] = "Failed units: " + strings.Join(names, ", ")
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// GetSystemdState returns the state reported by systemctl is-system-running and the failed units
+func GetSystemdState(ctx context.Context, timeout time.Duration) (string, []SystemdUnit, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Exits with a non zero status unless the system is running
+	out, _, err := CommandOutput(ctx, "systemctl", "is-system-running")
+	if err != nil {
+		return "", nil, err
+	}
+	state := strings.TrimSpace(string(out))
+
+	out, status, err := CommandOutput(ctx, "systemctl", "list-units", "--state=failed", "--all", "--no-legend", "--plain", "--full", "--no-pager")
+	if err != nil {
+		return state, nil, err
+	}
+	if status != 0 {
+		return state, nil, fmt.Errorf("systemctl list-units exit status %d", status)
+	}
+	return state, ParseSystemdUnits(string(out)), nil
+}
+
+// ParseSystemdUnits parses the output of systemctl list-units --no-legend --plain
+//
+//	nginx.service loaded failed failed A high performance web server
+func ParseSystemdUnits(output string) []SystemdUnit {
+	units := make([]SystemdUnit, 0)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Older versions mark failed units with a bullet even with --plain
+		if len(fields) > 0 && (fields[0] == "●" || fields[0] == "*") {
+			fields = fields[1:]
+		}
+		if len(fields) < 4 {
+			continue
+		}
+		units = append(units, SystemdUnit{
+			Name:        fields[0],
+			Load:        fields[1],
+			Active:      fields[2],
+			Sub:         fields[3],
+			Description: strings.Join(fields[4:], " "),
+		})
+	}
+	return units
+}
+
+// FilterUnits keeps the units matching an include pattern, every unit when there are none, and no exclude pattern
+func FilterUnits(units []SystemdUnit, include, exclude []*regexp.Regexp) []SystemdUnit {
+	ret := make([]SystemdUnit, 0, len(units))
+	for _, unit := range units {
+		if matchPatterns(unit.Name, include, exclude) {
+			ret = append(ret, unit)
+		}
+	}
+	return ret
+}
+
+// SystemdStatus fails when failed units remain, or without patterns when the system is degraded
+// A system that is starting or stopping is not failing.
+func SystemdStatus(state string, failed []SystemdUnit, filtered bool) string {
+	if len(failed) > 0 || (!filtered && state == "degraded") {
+		return "failing"
+	}
+	return "passing"
+}
+
+// RestartUnit clears the failed state of a unit and restarts it, retrying at most attempts times
+func (a *Agent) RestartUnit(ctx context.Context, name string, attempts int) ServiceRestart {
+	ret := ServiceRestart{Status: "failed"}
+	for ret.Attempts < attempts {
+		ret.Attempts++
+		a.Logger.Infoln("Unit", name, "has failed, restarting it, attempt", ret.Attempts)
+
+		attemptCtx, cancel := context.WithTimeout(ctx, SYSTEMD_CHECK_TIMEOUT*time.Second)
+		CommandOutput(attemptCtx, "systemctl", "reset-failed", name)
+		out, err := exec.CommandContext(attemptCtx, "systemctl", "restart", name).CombinedOutput()
+		if err != nil {
+			ret.ErrorMsg = strings.TrimSpace(string(out))
+			if ret.ErrorMsg == "" {
+				ret.ErrorMsg = err.Error()
+			}
+		}
+		active, _, _ := CommandOutput(attemptCtx, "systemctl", "is-active", name)
+		cancel()
+
+		ret.Status = strings.TrimSpace(string(active))
+		if ret.Status == "active" || ret.Status == "activating" {
+			ret.Success = true
+			ret.ErrorMsg = ""
+			return ret
+		}
+		if ret.Attempts == attempts || !sleepContext(ctx, SVC_CHECK_RESTART_DELAY*time.Second) {
+			break
+		}
+	}
+
+	if ret.ErrorMsg == "" {
+		ret.ErrorMsg = "Unit is " + ret.Status
+	}
+	a.Logger.Errorln("Unable to restart unit", name+":", ret.ErrorMsg)
+	return ret
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSystemdUnits(t *testing.T) {
+	output := `nginx.service   loaded failed failed A high performance web server
+● backup.timer  loaded failed failed Nightly backup
+broken
+`
+	want := []SystemdUnit{
+		{Name: "nginx.service", Load: "loaded", Active: "failed", Sub: "failed", Description: "A high performance web server"},
+		{Name: "backup.timer", Load: "loaded", Active: "failed", Sub: "failed", Description: "Nightly backup"},
+	}
+	units := ParseSystemdUnits(output)
+	if !reflect.DeepEqual(units, want) {
+		t.Fatalf("ParseSystemdUnits() = %+v, want %+v", units, want)
+	}
+
+	include, exclude, err := compilePatterns([]string{`\.service$`, `\.timer$`}, []string{`^backup`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered := FilterUnits(units, include, exclude)
+	if len(filtered) != 1 || filtered[0].Name != "nginx.service" {
+		t.Errorf("FilterUnits() = %+v, want nginx.service", filtered)
+	}
+}
+
+func TestSystemdStatus(t *testing.T) {
+	failed := []SystemdUnit{{Name: "nginx.service"}}
+	tests := []struct {
+		state    string
+		failed   []SystemdUnit
+		filtered bool
+		want     string
+	}{
+		{"running", nil, false, "passing"},
+		{"degraded", nil, false, "failing"},
+		// the degraded units didn't match the check's patterns
+		{"degraded", nil, true, "passing"},
+		{"degraded", failed, true, "failing"},
+		{"starting", nil, false, "passing"},
+	}
+	for _, tt := range tests {
+		if got := SystemdStatus(tt.state, tt.failed, tt.filtered); got != tt.want {
+			t.Errorf("SystemdStatus(%s, %d units, %v) = %s, want %s", tt.state, len(tt.failed), tt.filtered, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const (
+	TCP_CHECK_DEFAULT_TIMEOUT = 10
+	TCP_CHECK_MAX_BANNER      = 4096
+
+	TLS_CHECK_DEFAULT_PORT = 443
+)
+
+// TLSCertInfo details of the certificate presented by a server
+type TLSCertInfo struct {
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	SANs       []string  `json:"sans"`
+	NotAfter   time.Time `json:"not_after"`
+	DaysLeft   int       `json:"days_left"`
+	ChainValid bool      `json:"chain_valid"`
+	ChainError string    `json:"chain_error,omitempty"`
+}
+
+// TCPCheck connects to a host:port and optionally matches the banner it sends
+func (a *Agent) TCPCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	connectTime, banner, assertions, err := RunTCPCheck(ctx, data)
+	if err != nil {
+		a.Logger.Debugln("TCP check", checkAddress(data, 0), err)
+		payload["more_info"] = err.Error()
+	} else {
+		payload["connect_ms"] = connectTime.Milliseconds()
+		payload["banner"] = banner
+	}
+	payload["assertions"] = assertions
+	payload["status"] = assertionsStatus(err, assertions)
+	if payload["status"] == "failing" {
+		payload["severity"] = "error"
+	} else if data.ErrorThreshold > 0 && connectTime.Milliseconds() >= int64(data.ErrorThreshold) {
+		payload["status"], payload["severity"] = "failing", "error"
+	} else if data.WarningThreshold > 0 && connectTime.Milliseconds() >= int64(data.WarningThreshold) {
+		payload["status"], payload["severity"] = "failing", "warning"
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// RunTCPCheck connects to the check's target and reads its banner when a banner regex is set
+func RunTCPCheck(ctx context.Context, data rmm.Check) (time.Duration, string, []CheckAssertion, error) {
+	assertions := make([]CheckAssertion, 0)
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout(data, TCP_CHECK_DEFAULT_TIMEOUT))
+	defer cancel()
+
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", checkAddress(data, 0))
+	if err != nil {
+		return 0, "", assertions, err
+	}
+	defer conn.Close()
+	connectTime := time.Since(start)
+
+	if data.BannerRegex == "" {
+		return connectTime, "", assertions, nil
+	}
+
+	assertion := CheckAssertion{Name: "banner_regex"}
+	re, err := regexp.Compile(data.BannerRegex)
+	if err != nil {
+		assertion.Message = err.Error()
+		return connectTime, "", append(assertions, assertion), nil
+	}
+
+	// Read until the banner matches, the buffer is full or the timeout expires
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, TCP_CHECK_MAX_BANNER)
+	n := 0
+	for n < len(buf) {
+		read, err := conn.Read(buf[n:])
+		n += read
+		if re.Match(buf[:n]) || err != nil {
+			break
+		}
+	}
+
+	banner := strings.ToValidUTF8(string(buf[:n]), "")
+	if re.MatchString(banner) {
+		assertion.Passed = true
+		assertion.Message = fmt.Sprintf("banner matches %q", data.BannerRegex)
+	} else {
+		assertion.Message = fmt.Sprintf("banner does not match %q", data.BannerRegex)
+	}
+	return connectTime, banner, append(assertions, assertion), nil
+}
+
+// TLSCertCheck reports the expiry and validity of the certificate presented by a server
+func (a *Agent) TLSCertCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	info, err := GetTLSCertInfo(ctx, data)
+	if err != nil {
+		a.Logger.Debugln("TLS certificate check", checkAddress(data, TLS_CHECK_DEFAULT_PORT), err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	payload["cert"] = info
+	payload["days_left"] = info.DaysLeft
+	payload["status"] = "passing"
+	switch {
+	case !info.ChainValid, data.ErrorThreshold > 0 && info.DaysLeft <= data.ErrorThreshold, info.DaysLeft < 0:
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+	case data.WarningThreshold > 0 && info.DaysLeft <= data.WarningThreshold:
+		payload["status"] = "failing"
+		payload["severity"] = "warning"
+	}
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// GetTLSCertInfo completes a TLS handshake and verifies the presented chain against the system roots
+func GetTLSCertInfo(ctx context.Context, data rmm.Check) (TLSCertInfo, error) {
+	addr := checkAddress(data, TLS_CHECK_DEFAULT_PORT)
+	serverName := data.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+
+	// The chain is verified below, so expired or untrusted certificates can still be reported
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: checkTimeout(data, TCP_CHECK_DEFAULT_TIMEOUT)},
+		Config: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return TLSCertInfo{}, err
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return TLSCertInfo{}, fmt.Errorf("%s did not present a certificate", addr)
+	}
+	leaf := certs[0]
+
+	info := TLSCertInfo{
+		Subject:  leaf.Subject.String(),
+		Issuer:   leaf.Issuer.String(),
+		SANs:     leaf.DNSNames,
+		NotAfter: leaf.NotAfter.UTC(),
+		DaysLeft: int(math.Floor(time.Until(leaf.NotAfter).Hours() / 24)),
+	}
+	for _, ip := range leaf.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates}); err != nil {
+		info.ChainError = err.Error()
+	} else {
+		info.ChainValid = true
+	}
+	return info, nil
+}
+
+// checkAddress returns the host:port targeted by a tcp or tlscert check
+func checkAddress(data rmm.Check, defaultPort int) string {
+	port := data.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return net.JoinHostPort(data.Host, strconv.Itoa(port))
+}
+
+func checkTimeout(data rmm.Check, def int) time.Duration {
+	if data.Timeout > 0 {
+		return time.Duration(data.Timeout) * time.Second
+	}
+	return time.Duration(def) * time.Second
+}
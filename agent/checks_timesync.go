@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const (
+	TIMESYNC_DEFAULT_TIMEOUT = 10
+	NTP_DEFAULT_PORT         = 123
+
+	// Used when the check has no thresholds, in ms
+	TIMESYNC_DEFAULT_THRESHOLD = 1000
+
+	// Seconds between the NTP epoch (1900) and the Unix epoch
+	ntpEpochOffset = 2208988800
+	sntpPacketSize = 48
+)
+
+// TimeOffset the difference between a reference clock and the local clock, positive when the local clock is behind
+type TimeOffset struct {
+	Method    string  `json:"method"` // sntp or http
+	Reference string  `json:"reference"`
+	OffsetMS  float64 `json:"offset_ms"`
+	DelayMS   float64 `json:"delay_ms"`
+	Stratum   int     `json:"stratum,omitempty"`
+}
+
+// TimeSyncStatus the state of the local time synchronization service
+type TimeSyncStatus struct {
+	Service      string   `json:"service"` // chrony, timedatectl or w32time
+	Synchronized *bool    `json:"synchronized"`
+	Server       string   `json:"server,omitempty"`
+	Stratum      int      `json:"stratum,omitempty"`
+	OffsetMS     *float64 `json:"offset_ms,omitempty"` // as estimated by the service
+	Leap         string   `json:"leap,omitempty"`
+}
+
+// TimeSyncCheck measures the clock offset against the check's NTP server, or the RMM server's Date header
+// when no host is set, and reports the local time synchronization service's status
+func (a *Agent) TimeSyncCheck(ctx context.Context, data rmm.Check, r *resty.Client) {
+	payload := map[string]interface{}{
+		"id": data.CheckPK,
+	}
+
+	sync, err := getTimeSyncStatus(ctx)
+	if err != nil {
+		a.Logger.Debugln("Time sync status:", err)
+	} else {
+		payload["sync"] = sync
+	}
+
+	var offset TimeOffset
+	if data.Host != "" {
+		offset, err = SNTPOffset(ctx, checkAddress(data, NTP_DEFAULT_PORT), checkTimeout(data, TIMESYNC_DEFAULT_TIMEOUT))
+	} else {
+		offset, err = HTTPDateOffset(r, a.BaseURL)
+	}
+	if err != nil {
+		a.Logger.Debugln("Timesync check:", err)
+		payload["more_info"] = err.Error()
+		payload["status"] = "failing"
+		payload["severity"] = "error"
+		a.sendCheckResult(ctx, data, payload, r)
+		return
+	}
+
+	payload["offset"] = offset
+	payload["status"], payload["severity"] = TimeSyncCheckStatus(offset, sync, data)
+	payload["more_info"] = fmt.Sprintf("Clock offset %.0f ms from %s", offset.OffsetMS, offset.Reference)
+
+	a.sendCheckResult(ctx, data, payload, r)
+}
+
+// TimeSyncCheckStatus compares the absolute offset in ms to the check's thresholds
+// With require_sync, an unsynchronized time service is a warning.
+func TimeSyncCheckStatus(offset TimeOffset, sync TimeSyncStatus, data rmm.Check) (status, severity string) {
+	errThreshold := data.ErrorThreshold
+	if errThreshold <= 0 && data.WarningThreshold <= 0 {
+		errThreshold = TIMESYNC_DEFAULT_THRESHOLD
+	}
+	abs := math.Abs(offset.OffsetMS)
+	switch {
+	case errThreshold > 0 && abs >= float64(errThreshold):
+		return "failing", "error"
+	case data.WarningThreshold > 0 && abs >= float64(data.WarningThreshold):
+		return "failing", "warning"
+	case data.RequireSync && (sync.Synchronized == nil || !*sync.Synchronized):
+		return "failing", "warning"
+	}
+	return "passing", ""
+}
+
+// SNTPOffset queries an NTP server once (RFC 4330)
+func SNTPOffset(ctx context.Context, addr string, timeout time.Duration) (TimeOffset, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return TimeOffset{}, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	t1 := time.Now()
+	req := NewSNTPRequest(t1)
+	if _, err := conn.Write(req); err != nil {
+		return TimeOffset{}, err
+	}
+	resp := make([]byte, 512)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return TimeOffset{}, err
+	}
+
+	offset, err := ParseSNTPResponse(resp[:n], req, t1, t4)
+	offset.Reference = addr
+	return offset, err
+}
+
+// NewSNTPRequest builds a client request carrying the send time as its transmit timestamp
+func NewSNTPRequest(t time.Time) []byte {
+	req := make([]byte, sntpPacketSize)
+	req[0] = 0<<6 | 4<<3 | 3 // no leap warning, version 4, client mode
+	binary.BigEndian.PutUint64(req[40:], toNTPTime(t))
+	return req
+}
+
+// ParseSNTPResponse validates a server response to req and computes the offset and round trip delay,
+// t1 being when req was sent and t4 when the response was received
+func ParseSNTPResponse(resp, req []byte, t1, t4 time.Time) (TimeOffset, error) {
+	offset := TimeOffset{Method: "sntp"}
+	if len(resp) < sntpPacketSize {
+		return offset, fmt.Errorf("short NTP response: %d bytes", len(resp))
+	}
+	if mode := resp[0] & 0x7; mode != 4 {
+		return offset, fmt.Errorf("unexpected NTP mode %d", mode)
+	}
+	if resp[0]>>6 == 3 {
+		return offset, errors.New("NTP server is not synchronized")
+	}
+	offset.Stratum = int(resp[1])
+	if offset.Stratum == 0 {
+		return offset, fmt.Errorf("NTP server refused the request: %s", strings.TrimRight(string(resp[12:16]), "\x00"))
+	}
+	if string(resp[24:32]) != string(req[40:48]) {
+		return offset, errors.New("NTP response does not match the request")
+	}
+	if binary.BigEndian.Uint64(resp[40:]) == 0 {
+		return offset, errors.New("NTP response has no transmit timestamp")
+	}
+
+	t2 := fromNTPTime(binary.BigEndian.Uint64(resp[32:]))
+	t3 := fromNTPTime(binary.BigEndian.Uint64(resp[40:]))
+	offset.OffsetMS = durationMS((t2.Sub(t1) + t3.Sub(t4)) / 2)
+	offset.DelayMS = durationMS(t4.Sub(t1) - t3.Sub(t2))
+	return offset, nil
+}
+
+// HTTPDateOffset compares the Date header of the RMM server's response to the local clock
+// The header has a one second resolution, so offsets below a second can't be measured this way.
+func HTTPDateOffset(r *resty.Client, reference string) (TimeOffset, error) {
+	offset := TimeOffset{Method: "http", Reference: reference}
+	t1 := time.Now()
+	resp, err := r.R().Head("/")
+	t4 := time.Now()
+	if err != nil {
+		return offset, err
+	}
+	date, err := http.ParseTime(resp.Header().Get("Date"))
+	if err != nil {
+		return offset, fmt.Errorf("Date header: %s", err)
+	}
+
+	rtt := t4.Sub(t1)
+	// The header is truncated to the second, its middle is the best estimate
+	server := date.Add(500 * time.Millisecond)
+	offset.OffsetMS = durationMS(server.Sub(t1.Add(rtt / 2)))
+	offset.DelayMS = durationMS(rtt)
+	return offset, nil
+}
+
+// ParseChronyTracking parses the output of chronyc -c tracking
+//
+//	A9FEA97B,169.254.169.123,4,1667462311.153,-0.000001,...,Normal
+func ParseChronyTracking(output string) (TimeSyncStatus, error) {
+	status := TimeSyncStatus{Service: "chrony"}
+	fields := strings.Split(strings.TrimSpace(output), ",")
+	if len(fields) < 14 {
+		return status, fmt.Errorf("unexpected chronyc output: %q", output)
+	}
+	status.Server = fields[1]
+	status.Stratum, _ = strconv.Atoi(fields[2])
+	if v, err := strconv.ParseFloat(fields[4], 64); err == nil {
+		// seconds the system clock is fast (positive) or slow of NTP time
+		ms := -v * 1000
+		status.OffsetMS = &ms
+	}
+	status.Leap = fields[13]
+	synced := status.Leap != "Not synchronised" && status.Stratum > 0 && status.Stratum < 16
+	status.Synchronized = &synced
+	return status, nil
+}
+
+// ParseTimedatectl parses the output of timedatectl show
+func ParseTimedatectl(output string) (TimeSyncStatus, error) {
+	status := TimeSyncStatus{Service: "timedatectl"}
+	values := parseKeyValues(output, "=")
+	v, ok := values["NTPSynchronized"]
+	if !ok {
+		return status, errors.New("timedatectl did not report NTPSynchronized")
+	}
+	synced := v == "yes"
+	status.Synchronized = &synced
+	return status, nil
+}
+
+// ParseW32tmStatus parses the output of w32tm /query /status
+//
+//	Leap Indicator: 0(no warning)
+//	Stratum: 4 (secondary reference - syncd by (S)NTP)
+//	Source: time.windows.com,0x9
+func ParseW32tmStatus(output string) (TimeSyncStatus, error) {
+	status := TimeSyncStatus{Service: "w32time"}
+	values := parseKeyValues(output, ":")
+	leap, ok := values["Leap Indicator"]
+	if !ok {
+		return status, fmt.Errorf("unexpected w32tm output: %q", output)
+	}
+	status.Leap = leap
+	status.Server = values["Source"]
+	if i := strings.Index(status.Server, ","); i >= 0 {
+		status.Server = status.Server[:i]
+	}
+	status.Stratum, _ = strconv.Atoi(strings.Fields(values["Stratum"] + " 0")[0])
+
+	// 3 is unsynchronized, as is the local clock being its own source
+	synced := !strings.HasPrefix(leap, "3") && status.Stratum > 0 && status.Stratum < 16 &&
+		!strings.EqualFold(status.Server, "Local CMOS Clock") && !strings.EqualFold(status.Server, "Free-running System Clock")
+	status.Synchronized = &synced
+	return status, nil
+}
+
+func parseKeyValues(output, sep string) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), sep, 2)
+		if len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return values
+}
+
+func toNTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+func fromNTPTime(v uint64) time.Time {
+	secs := int64(v>>32) - ntpEpochOffset
+	nanos := int64((v & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
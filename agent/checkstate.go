@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const (
+	// Directory in the agent's program directory where checks keep their state between runs
+	CHECK_STATE_DIR = "checkstate"
+
+	// Number of recent results used for flap detection, and the minimum needed to detect it
+	FLAP_HISTORY     = 21
+	FLAP_MIN_HISTORY = 5
+)
+
+// CheckRunState the effective status of a check, derived from its recent raw results
+type CheckRunState struct {
+	Status   string `json:"status"`
+	Failures int    `json:"consecutive_failures"`
+	Passes   int    `json:"consecutive_passes"`
+	History  string `json:"history"` // oldest first, P for passing and F for failing
+	Flapping bool   `json:"flapping"`
+}
+
+// Update records a raw result
+// The status becomes failing after fails_b4_alert consecutive failures, and passing again after
+// passes_b4_recovery consecutive passes. When flap_high_threshold is set, the check starts flapping once
+// the percentage of state changes in its history reaches it, and stops below flap_low_threshold
+// (half the high threshold by default).
+func (s *CheckRunState) Update(raw string, data rmm.Check) {
+	if s.Status == "" {
+		s.Status = "passing"
+	}
+
+	mark := "P"
+	if raw == "failing" {
+		mark = "F"
+		s.Failures++
+		s.Passes = 0
+	} else {
+		s.Passes++
+		s.Failures = 0
+	}
+	s.History += mark
+	if len(s.History) > FLAP_HISTORY {
+		s.History = s.History[len(s.History)-FLAP_HISTORY:]
+	}
+
+	if s.Status == "passing" && s.Failures >= atLeastOne(data.FailsBeforeAlert) {
+		s.Status = "failing"
+	} else if s.Status == "failing" && s.Passes >= atLeastOne(data.PassesBeforeRecovery) {
+		s.Status = "passing"
+	}
+
+	if data.FlapHighThreshold <= 0 || len(s.History) < FLAP_MIN_HISTORY {
+		s.Flapping = false
+		return
+	}
+	low := data.FlapLowThreshold
+	if low <= 0 || low > data.FlapHighThreshold {
+		low = data.FlapHighThreshold / 2
+	}
+	changes := s.StateChangePercent()
+	if !s.Flapping && changes >= float64(data.FlapHighThreshold) {
+		s.Flapping = true
+	} else if s.Flapping && changes < float64(low) {
+		s.Flapping = false
+	}
+}
+
+// StateChangePercent returns the percentage of consecutive results in the history that differ
+func (s *CheckRunState) StateChangePercent() float64 {
+	if len(s.History) < 2 {
+		return 0
+	}
+	changes := 0
+	for i := 1; i < len(s.History); i++ {
+		if s.History[i] != s.History[i-1] {
+			changes++
+		}
+	}
+	return float64(changes) / float64(len(s.History)-1) * 100
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// LoadCheckState reads the state saved under name into v
+// Returns false when there is no saved state
+func (a *Agent) LoadCheckState(name string, v interface{}) (bool, error) {
+	content, err := os.ReadFile(filepath.Join(a.ProgramDir, CHECK_STATE_DIR, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, json.Unmarshal(content, v)
+}
+
+// SaveCheckState saves v under name, replacing the previous state atomically
+func (a *Agent) SaveCheckState(name string, v interface{}) error {
+	dir := filepath.Join(a.ProgramDir, CHECK_STATE_DIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// DeleteCheckState removes the state saved under name
+func (a *Agent) DeleteCheckState(name string) error {
+	err := os.Remove(filepath.Join(a.ProgramDir, CHECK_STATE_DIR, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
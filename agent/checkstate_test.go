@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func TestCheckRunStateUpdate(t *testing.T) {
+	data := rmm.Check{FailsBeforeAlert: 3, PassesBeforeRecovery: 2}
+	var s CheckRunState
+	steps := []struct {
+		raw  string
+		want string
+	}{
+		{"failing", "passing"},
+		{"failing", "passing"},
+		{"failing", "failing"},
+		{"passing", "failing"},
+		{"failing", "failing"},
+		{"passing", "failing"},
+		{"passing", "passing"},
+		{"failing", "passing"},
+	}
+	for i, step := range steps {
+		s.Update(step.raw, data)
+		if s.Status != step.want {
+			t.Fatalf("after result %d (%s): status %s, want %s", i+1, step.raw, s.Status, step.want)
+		}
+	}
+	if s.Failures != 1 || s.Passes != 0 {
+		t.Errorf("consecutive failures/passes = %d/%d, want 1/0", s.Failures, s.Passes)
+	}
+	if s.History != "FFFPFPPF" {
+		t.Errorf("History = %q", s.History)
+	}
+}
+
+func TestCheckRunStateUpdateDefaults(t *testing.T) {
+	var s CheckRunState
+	s.Update("failing", rmm.Check{})
+	if s.Status != "failing" {
+		t.Errorf("status after one failure = %s, want failing", s.Status)
+	}
+	s.Update("passing", rmm.Check{})
+	if s.Status != "passing" {
+		t.Errorf("status after one pass = %s, want passing", s.Status)
+	}
+}
+
+func TestCheckRunStateFlapping(t *testing.T) {
+	data := rmm.Check{FlapHighThreshold: 50, FlapLowThreshold: 20}
+	var s CheckRunState
+	for i := 0; i < 6; i++ {
+		raw := "passing"
+		if i%2 == 1 {
+			raw = "failing"
+		}
+		s.Update(raw, data)
+	}
+	if !s.Flapping {
+		t.Fatalf("not flapping with history %q", s.History)
+	}
+
+	for i := 0; i < FLAP_HISTORY; i++ {
+		s.Update("passing", data)
+		if len(s.History) > FLAP_HISTORY {
+			t.Fatalf("history grew to %d results", len(s.History))
+		}
+	}
+	if s.Flapping {
+		t.Errorf("still flapping with history %q", s.History)
+	}
+}
+
+func TestStateChangePercent(t *testing.T) {
+	tests := []struct {
+		history string
+		want    float64
+	}{
+		{"", 0},
+		{"P", 0},
+		{"PPPP", 0},
+		{"PFPF", 100},
+		{"PPFFP", 50},
+		{"PPPPF", 25},
+	}
+	for _, tt := range tests {
+		s := CheckRunState{History: tt.history}
+		if got := s.StateChangePercent(); got != tt.want {
+			t.Errorf("StateChangePercent(%q) = %v, want %v", tt.history, got, tt.want)
+		}
+	}
+}
+
+func TestSendCheckResultConcurrent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`"ok"`))
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t)
+	r := resty.New().SetBaseURL(srv.URL)
+	data := rmm.Check{CheckPK: 4, CheckType: CHECK_TYPE_PING}
+
+	const results = 10
+	var wg sync.WaitGroup
+	for i := 0; i < results; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload := map[string]interface{}{"id": data.CheckPK, "status": "failing"}
+			if err := a.sendCheckResult(context.Background(), data, payload, r); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var state CheckRunState
+	if _, err := a.LoadCheckState("check-4.json", &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Failures != results {
+		t.Errorf("%d consecutive failures recorded, want %d", state.Failures, results)
+	}
+}
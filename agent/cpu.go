@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rmm "github.com/sarog/rmmagent/shared"
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+const (
+	// How often the background sampler reads the processor times
+	CPU_SAMPLE_INTERVAL = 5 * time.Second
+	// Number of intervals the usage is averaged over
+	CPU_SAMPLE_WINDOW = 12
+)
+
+// LoadAverages the 1, 5 and 15 minute load averages, Linux only
+type LoadAverages struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+// CPUStats processor usage in percent, averaged over the sampler's window
+type CPUStats struct {
+	Percent float64       `json:"percent"`
+	PerCore []float64     `json:"per_core"`
+	IOWait  float64       `json:"iowait"`
+	Steal   float64       `json:"steal"`
+	Load    *LoadAverages `json:"load,omitempty"`
+	Cores   int           `json:"cores"`
+	Window  float64       `json:"window"` // seconds
+}
+
+// CPUSampler keeps the processor times of the last CPU_SAMPLE_WINDOW intervals
+// so the usage can be returned without waiting for a new sample
+type CPUSampler struct {
+	mu        sync.Mutex
+	snapshots []cpuSnapshot
+	running   bool
+}
+
+type cpuSnapshot struct {
+	at    time.Time
+	times []cpu.TimesStat
+}
+
+// NewCPUSampler creates a sampler, Run starts it
+func NewCPUSampler() *CPUSampler {
+	return &CPUSampler{}
+}
+
+// Run samples the processor times every CPU_SAMPLE_INTERVAL, forever
+func (s *CPUSampler) Run() {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = true
+	s.mu.Unlock()
+
+	s.sample()
+	for range time.Tick(CPU_SAMPLE_INTERVAL) {
+		s.sample()
+	}
+}
+
+// Stats returns the usage over the window
+// When the sampler isn't running, e.g. in a runchecks process, it waits for a one second sample.
+func (s *CPUSampler) Stats() (CPUStats, error) {
+	s.mu.Lock()
+	enough := len(s.snapshots) >= 2
+	s.mu.Unlock()
+
+	if !enough {
+		if err := s.sample(); err != nil {
+			return CPUStats{}, err
+		}
+		time.Sleep(time.Second)
+		if err := s.sample(); err != nil {
+			return CPUStats{}, err
+		}
+	}
+
+	s.mu.Lock()
+	first, last := s.snapshots[0], s.snapshots[len(s.snapshots)-1]
+	s.mu.Unlock()
+
+	stats := ComputeCPUStats(first.times, last.times)
+	stats.Window = last.at.Sub(first.at).Seconds()
+	stats.Load, _ = loadAverages()
+	return stats, nil
+}
+
+func (s *CPUSampler) sample() error {
+	times, err := cpu.Times(true)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots = append(s.snapshots, cpuSnapshot{at: time.Now(), times: times})
+	if len(s.snapshots) > CPU_SAMPLE_WINDOW+1 {
+		s.snapshots = s.snapshots[len(s.snapshots)-CPU_SAMPLE_WINDOW-1:]
+	}
+	return nil
+}
+
+// ComputeCPUStats returns the usage between two readings of the per core processor times
+// Cores missing from either reading are ignored, cores whose times didn't advance count as idle.
+func ComputeCPUStats(before, after []cpu.TimesStat) CPUStats {
+	prev := make(map[string]cpu.TimesStat, len(before))
+	for _, t := range before {
+		prev[t.CPU] = t
+	}
+
+	stats := CPUStats{PerCore: make([]float64, 0, len(after))}
+	var total, busy, iowait, steal float64
+	for _, cur := range after {
+		p, ok := prev[cur.CPU]
+		if !ok {
+			continue
+		}
+		// Guest time is already counted in user time
+		t := cpuTotal(cur) - cpuTotal(p)
+		idle := (cur.Idle - p.Idle) + (cur.Iowait - p.Iowait)
+		// No time elapsed, or a counter went backwards (wrapped, or the core went offline)
+		if t <= 0 || !cpuTimesIncreased(p, cur) {
+			stats.PerCore = append(stats.PerCore, 0)
+			continue
+		}
+		stats.PerCore = append(stats.PerCore, roundPercent((t-idle)/t*100))
+		total += t
+		busy += t - idle
+		iowait += cur.Iowait - p.Iowait
+		steal += cur.Steal - p.Steal
+	}
+	stats.Cores = len(stats.PerCore)
+	if total > 0 {
+		stats.Percent = roundPercent(busy / total * 100)
+		stats.IOWait = roundPercent(iowait / total * 100)
+		stats.Steal = roundPercent(steal / total * 100)
+	}
+	return stats
+}
+
+// CPUThresholdsSet returns true when the check has any of the thresholds evaluated by the agent
+// Otherwise the server evaluates the usage percent against its own thresholds.
+func CPUThresholdsSet(data rmm.Check) bool {
+	return data.CoreWarningThreshold > 0 || data.CoreErrorThreshold > 0 ||
+		data.IOWaitWarningThreshold > 0 || data.IOWaitErrorThreshold > 0 ||
+		data.StealWarningThreshold > 0 || data.StealErrorThreshold > 0 ||
+		data.LoadWarningThreshold > 0 || data.LoadErrorThreshold > 0
+}
+
+// CPUStatus compares the processor usage to the check's thresholds
+// Load thresholds apply to the 5 minute load average per core, and are ignored without load averages.
+func CPUStatus(stats CPUStats, data rmm.Check) (status, severity string) {
+	over := func(value float64, threshold int) bool {
+		return threshold > 0 && value >= float64(threshold)
+	}
+	busiest := 0.0
+	for _, p := range stats.PerCore {
+		if p > busiest {
+			busiest = p
+		}
+	}
+	load := -1.0
+	if stats.Load != nil {
+		cores := stats.Cores
+		if cores == 0 {
+			cores = runtime.NumCPU()
+		}
+		load = stats.Load.Load5 / float64(cores)
+	}
+	overLoad := func(threshold float64) bool {
+		return threshold > 0 && load >= threshold
+	}
+
+	switch {
+	case over(stats.Percent, data.ErrorThreshold),
+		over(busiest, data.CoreErrorThreshold),
+		over(stats.IOWait, data.IOWaitErrorThreshold),
+		over(stats.Steal, data.StealErrorThreshold),
+		overLoad(data.LoadErrorThreshold):
+		return "failing", "error"
+	case over(stats.Percent, data.WarningThreshold),
+		over(busiest, data.CoreWarningThreshold),
+		over(stats.IOWait, data.IOWaitWarningThreshold),
+		over(stats.Steal, data.StealWarningThreshold),
+		overLoad(data.LoadWarningThreshold):
+		return "failing", "warning"
+	}
+	return "passing", ""
+}
+
+// ParseLoadAvg parses the content of /proc/loadavg
+func ParseLoadAvg(content string) (*LoadAverages, error) {
+	fields := strings.Fields(content)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected loadavg: %q", content)
+	}
+	values := make([]float64, 3)
+	for i := range values {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("loadavg: %s", err)
+		}
+		values[i] = v
+	}
+	return &LoadAverages{Load1: values[0], Load5: values[1], Load15: values[2]}, nil
+}
+
+func cpuTotal(t cpu.TimesStat) float64 {
+	return t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+}
+
+// cpuTimesIncreased returns false if any of the processor times went backwards
+func cpuTimesIncreased(before, after cpu.TimesStat) bool {
+	return after.User >= before.User && after.System >= before.System && after.Idle >= before.Idle &&
+		after.Nice >= before.Nice && after.Iowait >= before.Iowait && after.Irq >= before.Irq &&
+		after.Softirq >= before.Softirq && after.Steal >= before.Steal
+}
+
+func roundPercent(v float64) float64 {
+	return float64(int(v*10+0.5)) / 10
+}
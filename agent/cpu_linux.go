@@ -0,0 +1,11 @@
+package agent
+
+import "os"
+
+func loadAverages() (*LoadAverages, error) {
+	content, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	return ParseLoadAvg(string(content))
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	rmm "github.com/sarog/rmmagent/shared"
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+func TestComputeCPUStats(t *testing.T) {
+	before := []cpu.TimesStat{
+		{CPU: "cpu0", User: 100, System: 50, Idle: 800, Iowait: 50},
+		{CPU: "cpu1", User: 100, System: 50, Idle: 850},
+	}
+
+	tests := []struct {
+		name  string
+		after []cpu.TimesStat
+		want  CPUStats
+	}{
+		{
+			name: "busy and idle cores",
+			after: []cpu.TimesStat{
+				// 100 seconds: 60 user, 20 system, 10 idle, 10 iowait
+				{CPU: "cpu0", User: 160, System: 70, Idle: 810, Iowait: 60},
+				// 100 seconds: 10 user, 90 idle
+				{CPU: "cpu1", User: 110, System: 50, Idle: 940},
+			},
+			want: CPUStats{Percent: 45, PerCore: []float64{80, 10}, IOWait: 5, Cores: 2},
+		},
+		{
+			name: "steal time",
+			after: []cpu.TimesStat{
+				{CPU: "cpu0", User: 130, System: 50, Idle: 850, Iowait: 50, Steal: 20},
+				{CPU: "cpu1", User: 100, System: 50, Idle: 850},
+			},
+			want: CPUStats{Percent: 50, PerCore: []float64{50, 0}, Steal: 20, Cores: 2},
+		},
+		{
+			name:  "zero deltas",
+			after: before,
+			want:  CPUStats{PerCore: []float64{0, 0}, Cores: 2},
+		},
+		{
+			name: "counter wrap",
+			after: []cpu.TimesStat{
+				// idle went backwards, the reading is discarded
+				{CPU: "cpu0", User: 300, System: 50, Idle: 10, Iowait: 50},
+				{CPU: "cpu1", User: 150, System: 50, Idle: 900},
+			},
+			want: CPUStats{Percent: 50, PerCore: []float64{0, 50}, Cores: 2},
+		},
+		{
+			name: "core only in one reading",
+			after: []cpu.TimesStat{
+				{CPU: "cpu1", User: 110, System: 50, Idle: 940},
+				{CPU: "cpu2", User: 500, System: 500},
+			},
+			want: CPUStats{Percent: 10, PerCore: []float64{10}, Cores: 1},
+		},
+	}
+	for _, tt := range tests {
+		got := ComputeCPUStats(before, tt.after)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ComputeCPUStats() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseLoadAvg(t *testing.T) {
+	got, err := ParseLoadAvg("0.52 1.20 2.05 3/1245 98765\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &LoadAverages{Load1: 0.52, Load5: 1.2, Load15: 2.05}
+	if *got != *want {
+		t.Errorf("ParseLoadAvg() = %+v, want %+v", got, want)
+	}
+
+	for _, content := range []string{"", "0.52 1.20", "0.52 high 2.05 3/1245 98765"} {
+		if _, err := ParseLoadAvg(content); err == nil {
+			t.Errorf("ParseLoadAvg(%q) should fail", content)
+		}
+	}
+}
+
+func TestCPUStatus(t *testing.T) {
+	stats := CPUStats{
+		Percent: 40,
+		PerCore: []float64{95, 10, 30, 25},
+		IOWait:  12,
+		Load:    &LoadAverages{Load5: 6},
+		Cores:   4,
+	}
+	tests := []struct {
+		name     string
+		check    rmm.Check
+		status   string
+		severity string
+	}{
+		{"under thresholds", rmm.Check{WarningThreshold: 70, ErrorThreshold: 90}, "passing", ""},
+		{"busiest core", rmm.Check{CoreWarningThreshold: 90}, "failing", "warning"},
+		{"iowait error", rmm.Check{IOWaitWarningThreshold: 5, IOWaitErrorThreshold: 10}, "failing", "error"},
+		// 6 / 4 cores = 1.5 per core
+		{"load per core", rmm.Check{LoadWarningThreshold: 1, LoadErrorThreshold: 2}, "failing", "warning"},
+		{"load under", rmm.Check{LoadErrorThreshold: 2}, "passing", ""},
+	}
+	for _, tt := range tests {
+		status, severity := CPUStatus(stats, tt.check)
+		if status != tt.status || severity != tt.severity {
+			t.Errorf("%s: CPUStatus() = %s/%s, want %s/%s", tt.name, status, severity, tt.status, tt.severity)
+		}
+	}
+
+	// Without load averages, e.g. on Windows, the load thresholds are ignored
+	stats.Load = nil
+	if status, _ := CPUStatus(stats, rmm.Check{LoadErrorThreshold: 0.1}); status != "passing" {
+		t.Errorf("CPUStatus() without load averages = %s, want passing", status)
+	}
+}
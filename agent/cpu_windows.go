@@ -0,0 +1,6 @@
+package agent
+
+// Windows has no load averages
+func loadAverages() (*LoadAverages, error) {
+	return nil, nil
+}
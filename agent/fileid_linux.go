@@ -0,0 +1,21 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileIdentity identifies an open file by its device and inode numbers
+// It stays the same when the file is renamed, e.g. by log rotation
+func fileIdentity(f *os.File) (string, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("unable to get the inode of %s", f.Name())
+	}
+	return fmt.Sprintf("%x-%x", st.Dev, st.Ino), nil
+}
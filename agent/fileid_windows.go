@@ -0,0 +1,17 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileIdentity identifies an open file by its volume serial number and file index
+// It stays the same when the file is renamed, e.g. by log rotation
+func fileIdentity(f *os.File) (string, error) {
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &info); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x%08x", info.VolumeSerialNumber, info.FileIndexHigh, info.FileIndexLow), nil
+}
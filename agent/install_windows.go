@@ -35,6 +35,7 @@ type Installer struct {
 	MeshDir       string // 2022-01-02: backported // todo: 2023-04-17: remove
 	MeshDisabled  bool   // 2022-01-02: backported // todo: 2023-04-17: remove
 	Cert          string
+	ScriptKeys    string // comma separated, base64 encoded Ed25519 public keys
 	Timeout       time.Duration
 	SaltMaster    string // todo: 2023-04-17: remove
 	Silent        bool
@@ -55,17 +56,23 @@ const (
 	AGENT_MODE_SVC = "winagentsvc"
 
 	// Registry strings
-	REG_RMM_PATH      = `SOFTWARE\RMMAgent`
-	REG_RMM_BASEURL   = "BaseURL"
-	REG_RMM_AGENTID   = "AgentID"
-	REG_RMM_APIURL    = "ApiURL"
-	REG_RMM_TOKEN     = "Token"
-	REG_RMM_AGENTPK   = "AgentPK"
-	REG_RMM_CERT      = "Cert"
-	REG_RMM_PYENABLED = "PythonEnabled"
+	REG_RMM_PATH       = `SOFTWARE\RMMAgent`
+	REG_RMM_BASEURL    = "BaseURL"
+	REG_RMM_AGENTID    = "AgentID"
+	REG_RMM_APIURL     = "ApiURL"
+	REG_RMM_TOKEN      = "Token"
+	REG_RMM_AGENTPK    = "AgentPK"
+	REG_RMM_CERT       = "Cert"
+	REG_RMM_PYENABLED  = "PythonEnabled"
+	REG_RMM_SCRIPTKEYS = "ScriptSigningKeys"
+
+	// Optional, not created by the installer
+	REG_RMM_MAXOUTPUT        = "MaxOutputBytes"    // per-stream limit of script output, 0 disables it
+	REG_RMM_UPLOADOUTPUT     = "UploadLargeOutput" // upload output exceeding MaxOutputBytes as artifacts
+	REG_RMM_CHECKCONCURRENCY = "CheckConcurrency"  // number of checks run at the same time by runchecks
 )
 
-func createRegKeys(baseurl, agentid, apiurl, token, agentpk, cert string, pyEnabled bool) {
+func createRegKeys(baseurl, agentid, apiurl, token, agentpk, cert string, pyEnabled bool, scriptKeys []string) {
 	// todo: 2021-12-31: migrate to DPAPI?
 	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, REG_RMM_PATH, registry.ALL_ACCESS)
 	if err != nil {
@@ -109,6 +116,13 @@ func createRegKeys(baseurl, agentid, apiurl, token, agentpk, cert string, pyEnab
 	if err != nil {
 		log.Fatalln("Error creating PythonEnabled registry key:", err)
 	}
+
+	if len(scriptKeys) > 0 {
+		err = key.SetStringsValue(REG_RMM_SCRIPTKEYS, scriptKeys)
+		if err != nil {
+			log.Fatalln("Error creating ScriptSigningKeys registry key:", err)
+		}
+	}
 }
 
 func (a *Agent) Install(i *Installer) {
@@ -130,6 +144,14 @@ func (a *Agent) Install(i *Installer) {
 		a.installerMsg("Invalid URL: must begin with https or http", "error", i.Silent)
 	}
 
+	scriptKeys := make([]string, 0)
+	if len(i.ScriptKeys) > 0 {
+		scriptKeys = strings.Split(i.ScriptKeys, ",")
+		if _, err := ParseScriptSigningKeys(scriptKeys); err != nil {
+			a.installerMsg(err.Error(), "error", i.Silent)
+		}
+	}
+
 	// This will match either IPv4 or IPv4:port
 	var ipPort = regexp.MustCompile(`[0-9]+(?:\.[0-9]+){3}(:[0-9]+)?`)
 
@@ -301,7 +323,7 @@ func (a *Agent) Install(i *Installer) {
 	a.Logger.Debugln("Agent PK:", agentPK)
 	a.Logger.Debugln("Salt ID:", saltID)
 
-	createRegKeys(baseURL, a.AgentID, i.SaltMaster, agentToken, strconv.Itoa(agentPK), i.Cert, a.PythonEnabled)
+	createRegKeys(baseURL, a.AgentID, i.SaltMaster, agentToken, strconv.Itoa(agentPK), i.Cert, a.PythonEnabled, scriptKeys)
 	// Refresh our agent with new values
 	a = New(a.Logger, a.Version)
 
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Directory in the agent's program directory holding the lock files
+	LOCK_DIR = "locks"
+
+	// Held while checks run in the runchecks and checkrunner modes
+	LOCK_CHECKS = "checks"
+
+	// How long AcquireLock waits for a lock held by LockHeld
+	LOCK_PROBE_WAIT = 200 * time.Millisecond
+	// How long a check result waits for another result of the same check to update its state
+	LOCK_CHECK_STATE_WAIT = 30 * time.Second
+	// Delay between attempts to take a held lock
+	LOCK_RETRY_DELAY = 20 * time.Millisecond
+)
+
+// ErrLocked is returned when another process, or another run in this process, holds the lock
+var ErrLocked = errors.New("lock is held by another run")
+
+// RunLock an exclusive advisory lock shared by the agent's processes
+// The lock is held by the operating system on the open file (LockFileEx on Windows, flock on Linux)
+// and is released when the holder exits, even if it crashes, so a lock file left behind is never stale.
+// The file records the holder's PID and start time for diagnostics only.
+type RunLock struct {
+	Name string
+	path string
+	f    *os.File
+}
+
+// LockHolder the process that last acquired a lock
+type LockHolder struct {
+	PID     int
+	Started time.Time
+}
+
+// AcquireLock takes the named lock, returns ErrLocked when it is held
+// It only waits for LOCK_PROBE_WAIT, in case LockHeld is probing the lock at the same time.
+func (a *Agent) AcquireLock(name string) (*RunLock, error) {
+	return a.AcquireLockWait(name, LOCK_PROBE_WAIT)
+}
+
+// AcquireLockWait takes the named lock, retrying for at most wait while it is held
+func (a *Agent) AcquireLockWait(name string, wait time.Duration) (*RunLock, error) {
+	dir := filepath.Join(a.ProgramDir, LOCK_DIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, name+".lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		err = lockFile(f)
+		if !errors.Is(err, ErrLocked) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(LOCK_RETRY_DELAY)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Only the holder writes the file
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339))), 0)
+	}
+	return &RunLock{Name: name, path: path, f: f}, nil
+}
+
+// Release gives the lock up
+func (l *RunLock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := unlockFile(l.f)
+	l.f.Close()
+	l.f = nil
+	return err
+}
+
+// LockHeld returns true when the named lock is currently held
+// The lock is only taken for as long as the test lasts, the holder's file is left untouched.
+func (a *Agent) LockHeld(name string) bool {
+	f, err := os.Open(filepath.Join(a.ProgramDir, LOCK_DIR, name+".lock"))
+	if err != nil {
+		// Never acquired
+		return false
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return errors.Is(err, ErrLocked)
+	}
+	unlockFile(f)
+	return false
+}
+
+// GetLockHolder returns the process that last acquired the named lock
+func (a *Agent) GetLockHolder(name string) (LockHolder, error) {
+	var holder LockHolder
+	content, err := os.ReadFile(filepath.Join(a.ProgramDir, LOCK_DIR, name+".lock"))
+	if err != nil {
+		return holder, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if holder.PID, err = strconv.Atoi(strings.TrimSpace(lines[0])); err != nil {
+		return holder, fmt.Errorf("lock %s: %s", name, err)
+	}
+	if len(lines) > 1 {
+		holder.Started, _ = time.Parse(time.RFC3339, strings.TrimSpace(lines[1]))
+	}
+	return holder, nil
+}
+
+// lockBusy logs who holds a lock that couldn't be acquired
+func (a *Agent) lockBusy(name string) {
+	if holder, err := a.GetLockHolder(name); err == nil {
+		a.Logger.Debugln("Lock", name, "is held by pid", holder.PID, "since", holder.Started)
+		return
+	}
+	a.Logger.Debugln("Lock", name, "is held")
+}
+
+// taskLock name of the lock preventing a task from running twice at the same time
+func taskLock(id int) string {
+	return fmt.Sprintf("task-%d", id)
+}
+
+// checkRunLock name of the lock held while a check runs, by the scheduler and by runchecks
+func checkRunLock(id int) string {
+	return fmt.Sprintf("checkrun-%d", id)
+}
+
+// checkStateLock name of the lock held while a check's state is read, updated and saved
+func checkStateLock(id int) string {
+	return fmt.Sprintf("check-%d", id)
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestAgent(t *testing.T) *Agent {
+	t.Helper()
+	return &Agent{ProgramDir: t.TempDir(), Logger: logrus.New()}
+}
+
+func TestAcquireLock(t *testing.T) {
+	a := newTestAgent(t)
+	if a.LockHeld(LOCK_CHECKS) {
+		t.Fatal("LockHeld() before the lock was ever acquired")
+	}
+
+	lock, err := a.AcquireLock(LOCK_CHECKS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, err := a.GetLockHolder(LOCK_CHECKS)
+	if err != nil || holder.PID != os.Getpid() {
+		t.Errorf("GetLockHolder() = %+v, %v, want pid %d", holder, err, os.Getpid())
+	}
+
+	if _, err := a.AcquireLock(LOCK_CHECKS); !errors.Is(err, ErrLocked) {
+		t.Errorf("AcquireLock() of a held lock = %v, want ErrLocked", err)
+	}
+
+	path := filepath.Join(a.ProgramDir, LOCK_DIR, LOCK_CHECKS+".lock")
+	before, _ := os.ReadFile(path)
+	if !a.LockHeld(LOCK_CHECKS) {
+		t.Error("LockHeld() = false while the lock is held")
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Errorf("LockHeld() rewrote the holder file: %q, was %q", after, before)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if a.LockHeld(LOCK_CHECKS) {
+		t.Error("LockHeld() = true after Release()")
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Errorf("LockHeld() rewrote the holder file: %q, was %q", after, before)
+	}
+}
+
+func TestAcquireLockWait(t *testing.T) {
+	a := newTestAgent(t)
+	lock, err := a.AcquireLock(taskLock(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lock.Release()
+	}()
+
+	second, err := a.AcquireLockWait(taskLock(7), 2*time.Second)
+	if err != nil {
+		t.Fatalf("AcquireLockWait() = %v, want the lock once released", err)
+	}
+	second.Release()
+}
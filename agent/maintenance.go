@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const (
+	// Windows set on the agent with setmaintenance
+	AGENT_MAINTENANCE_FILE = "maintenance.json"
+	// Windows pushed with the check definitions
+	AGENT_SERVER_MAINTENANCE_FILE = "maintenance-server.json"
+
+	MAINTENANCE_SOURCE_LOCAL  = "local"
+	MAINTENANCE_SOURCE_SERVER = "server"
+
+	MAINTENANCE_ACTION_SKIP   = "skip"
+	MAINTENANCE_ACTION_REPORT = "maintenance"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// LoadMaintenanceWindows reads the maintenance windows stored by the agent
+func LoadMaintenanceWindows(path string) ([]rmm.MaintenanceWindow, error) {
+	ret := make([]rmm.MaintenanceWindow, 0)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &ret); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return ret, nil
+}
+
+// SaveMaintenanceWindows validates and stores maintenance windows, replacing the previous ones
+// One-off windows that have already ended are dropped
+func SaveMaintenanceWindows(path string, windows []rmm.MaintenanceWindow) error {
+	keep := make([]rmm.MaintenanceWindow, 0, len(windows))
+	now := time.Now()
+	for _, w := range windows {
+		if err := ValidateMaintenanceWindow(w); err != nil {
+			return err
+		}
+		if w.End != "" {
+			if end, _ := time.Parse(time.RFC3339, w.End); end.Before(now) {
+				continue
+			}
+		}
+		// the source is given by the file the window is stored in
+		w.Source = ""
+		keep = append(keep, w)
+	}
+
+	content, err := json.MarshalIndent(keep, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ValidateMaintenanceWindow checks that a window is either one-off or recurring, with valid fields
+func ValidateMaintenanceWindow(w rmm.MaintenanceWindow) error {
+	switch w.Action {
+	case "", MAINTENANCE_ACTION_SKIP, MAINTENANCE_ACTION_REPORT:
+	default:
+		return fmt.Errorf("maintenance window %s: invalid action %q", w.ID, w.Action)
+	}
+
+	if w.Start != "" || w.End != "" {
+		start, err := time.Parse(time.RFC3339, w.Start)
+		if err != nil {
+			return fmt.Errorf("maintenance window %s: start: %s", w.ID, err)
+		}
+		end, err := time.Parse(time.RFC3339, w.End)
+		if err != nil {
+			return fmt.Errorf("maintenance window %s: end: %s", w.ID, err)
+		}
+		if !end.After(start) {
+			return fmt.Errorf("maintenance window %s: end is not after start", w.ID)
+		}
+		return nil
+	}
+
+	if _, err := time.Parse("15:04", w.StartTime); err != nil {
+		return fmt.Errorf("maintenance window %s: start_time: %s", w.ID, err)
+	}
+	if w.Duration <= 0 {
+		return fmt.Errorf("maintenance window %s: duration must be positive", w.ID)
+	}
+	for _, d := range w.Weekdays {
+		if _, ok := weekdays[weekdayKey(d)]; !ok {
+			return fmt.Errorf("maintenance window %s: invalid weekday %q", w.ID, d)
+		}
+	}
+	return nil
+}
+
+// MaintenanceActive returns true when the window covers the check type at the given time
+func MaintenanceActive(w rmm.MaintenanceWindow, checkType string, now time.Time) bool {
+	if len(w.CheckTypes) > 0 {
+		covered := false
+		for _, t := range w.CheckTypes {
+			if strings.EqualFold(t, checkType) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+
+	if w.Start != "" {
+		start, err1 := time.Parse(time.RFC3339, w.Start)
+		end, err2 := time.Parse(time.RFC3339, w.End)
+		return err1 == nil && err2 == nil && !now.Before(start) && now.Before(end)
+	}
+
+	startTime, err := time.Parse("15:04", w.StartTime)
+	if err != nil || w.Duration <= 0 {
+		return false
+	}
+	duration := time.Duration(w.Duration) * time.Minute
+
+	// A window may have started on a previous day and still be running
+	for days := 0; days <= int(duration.Hours()/24)+1; days++ {
+		day := now.AddDate(0, 0, -days)
+		start := time.Date(day.Year(), day.Month(), day.Day(), startTime.Hour(), startTime.Minute(), 0, 0, now.Location())
+		if !onWeekday(w.Weekdays, start.Weekday()) {
+			continue
+		}
+		if !now.Before(start) && now.Before(start.Add(duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+type maintenanceKey struct{}
+
+// withMaintenanceWindows loads the agent's maintenance windows once, for every check run with the returned context
+func (a *Agent) withMaintenanceWindows(ctx context.Context) context.Context {
+	windows, err := a.GetMaintenanceWindows()
+	if err != nil {
+		a.Logger.Errorln("Unable to load maintenance windows:", err)
+		windows = make([]rmm.MaintenanceWindow, 0)
+	}
+	return context.WithValue(ctx, maintenanceKey{}, windows)
+}
+
+// ActiveMaintenance returns the first maintenance window covering the check type, or nil
+// The windows carried by ctx are used, they are loaded when ctx doesn't have any.
+func (a *Agent) ActiveMaintenance(ctx context.Context, checkType string) *rmm.MaintenanceWindow {
+	windows, ok := ctx.Value(maintenanceKey{}).([]rmm.MaintenanceWindow)
+	if !ok {
+		windows, _ = a.withMaintenanceWindows(ctx).Value(maintenanceKey{}).([]rmm.MaintenanceWindow)
+	}
+	now := time.Now()
+	for i := range windows {
+		if MaintenanceActive(windows[i], checkType, now) {
+			return &windows[i]
+		}
+	}
+	return nil
+}
+
+// SetMaintenanceWindows replaces the maintenance windows set on the agent
+// The windows pushed by the server are kept.
+func (a *Agent) SetMaintenanceWindows(windows []rmm.MaintenanceWindow) error {
+	return SaveMaintenanceWindows(filepath.Join(a.ProgramDir, AGENT_MAINTENANCE_FILE), windows)
+}
+
+// GetMaintenanceWindows returns the windows set on the agent followed by the ones pushed by the server
+func (a *Agent) GetMaintenanceWindows() ([]rmm.MaintenanceWindow, error) {
+	ret := make([]rmm.MaintenanceWindow, 0)
+	for _, src := range []struct{ file, source string }{
+		{AGENT_MAINTENANCE_FILE, MAINTENANCE_SOURCE_LOCAL},
+		{AGENT_SERVER_MAINTENANCE_FILE, MAINTENANCE_SOURCE_SERVER},
+	} {
+		windows, err := LoadMaintenanceWindows(filepath.Join(a.ProgramDir, src.file))
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range windows {
+			w.Source = src.source
+			ret = append(ret, w)
+		}
+	}
+	return ret, nil
+}
+
+// syncMaintenanceWindows replaces the windows pushed by the server with the ones sent with the check definitions
+// Nothing changes when the server didn't send the list, the windows set on the agent are never touched.
+func (a *Agent) syncMaintenanceWindows(windows []rmm.MaintenanceWindow) {
+	if windows == nil {
+		return
+	}
+	if err := SaveMaintenanceWindows(filepath.Join(a.ProgramDir, AGENT_SERVER_MAINTENANCE_FILE), windows); err != nil {
+		a.Logger.Errorln("Unable to save maintenance windows:", err)
+	}
+}
+
+// maintenanceCheck reports a check covered by a maintenance window instead of running it
+func (a *Agent) maintenanceCheck(data rmm.Check, w *rmm.MaintenanceWindow, r *resty.Client) {
+	if w.Action == MAINTENANCE_ACTION_SKIP {
+		a.Logger.Debugln("Check", data.CheckPK, "skipped by maintenance window", w.ID)
+		return
+	}
+
+	payload := map[string]interface{}{
+		"id":                 data.CheckPK,
+		"status":             MAINTENANCE_ACTION_REPORT,
+		"maintenance_window": w.ID,
+	}
+	if _, err := r.R().SetBody(payload).Patch(API_URL_CHECKRUNNER); err != nil {
+		a.Logger.Debugln(err)
+	}
+}
+
+func onWeekday(days []string, wd time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, d := range days {
+		if day, ok := weekdays[weekdayKey(d)]; ok && day == wd {
+			return true
+		}
+	}
+	return false
+}
+
+func weekdayKey(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+	if len(d) > 3 {
+		d = d[:3]
+	}
+	return d
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func TestMaintenanceActiveAcrossMidnight(t *testing.T) {
+	// Monday 23:00 for two hours
+	w := rmm.MaintenanceWindow{ID: "nightly", StartTime: "23:00", Duration: 120, Weekdays: []string{"mon"}}
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"before", time.Date(2022, 3, 14, 22, 59, 0, 0, time.UTC), false},
+		{"monday", time.Date(2022, 3, 14, 23, 30, 0, 0, time.UTC), true},
+		{"tuesday", time.Date(2022, 3, 15, 0, 30, 0, 0, time.UTC), true},
+		{"ended", time.Date(2022, 3, 15, 1, 0, 0, 0, time.UTC), false},
+		{"tuesday night", time.Date(2022, 3, 15, 23, 30, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := MaintenanceActive(w, CHECK_TYPE_PING, tt.now); got != tt.want {
+			t.Errorf("%s: MaintenanceActive(%v) = %v, want %v", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestMaintenanceActiveTimeZones(t *testing.T) {
+	sydney := time.FixedZone("AEST", 10*60*60)
+	// 2022-03-14 14:30 UTC is 2022-03-15 00:30 in Sydney
+	now := time.Date(2022, 3, 14, 14, 30, 0, 0, time.UTC)
+
+	// Recurring windows follow the agent's local time
+	w := rmm.MaintenanceWindow{ID: "night", StartTime: "00:00", Duration: 60, Weekdays: []string{"tue"}}
+	if MaintenanceActive(w, CHECK_TYPE_PING, now) {
+		t.Error("recurring window active at 14:30 UTC")
+	}
+	if !MaintenanceActive(w, CHECK_TYPE_PING, now.In(sydney)) {
+		t.Error("recurring window not active at 00:30 on Tuesday in Sydney")
+	}
+
+	// One-off windows are absolute, whatever the offsets
+	w = rmm.MaintenanceWindow{ID: "patching", Start: "2022-03-15T00:00:00+10:00", End: "2022-03-14T15:00:00Z"}
+	for _, loc := range []*time.Location{time.UTC, sydney} {
+		if !MaintenanceActive(w, CHECK_TYPE_PING, now.In(loc)) {
+			t.Errorf("one-off window not active at %v", now.In(loc))
+		}
+	}
+}
+
+func TestMaintenanceActiveCheckTypes(t *testing.T) {
+	w := rmm.MaintenanceWindow{StartTime: "00:00", Duration: 24 * 60, CheckTypes: []string{"DiskSpace"}}
+	now := time.Date(2022, 3, 14, 12, 0, 0, 0, time.UTC)
+	if !MaintenanceActive(w, CHECK_TYPE_DISKSPACE, now) {
+		t.Error("window not active for a covered check type")
+	}
+	if MaintenanceActive(w, CHECK_TYPE_PING, now) {
+		t.Error("window active for a check type it doesn't cover")
+	}
+}
+
+func TestMaintenanceWindowSources(t *testing.T) {
+	a := newTestAgent(t)
+	local := []rmm.MaintenanceWindow{{ID: "local", StartTime: "00:00", Duration: 24 * 60}}
+	if err := a.SetMaintenanceWindows(local); err != nil {
+		t.Fatal(err)
+	}
+	a.syncMaintenanceWindows([]rmm.MaintenanceWindow{{ID: "server", StartTime: "00:00", Duration: 60}})
+	// A server push without windows clears the server's windows only
+	a.syncMaintenanceWindows([]rmm.MaintenanceWindow{})
+
+	windows, err := a.GetMaintenanceWindows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 1 || windows[0].ID != "local" || windows[0].Source != MAINTENANCE_SOURCE_LOCAL {
+		t.Fatalf("GetMaintenanceWindows() = %+v, want the local window only", windows)
+	}
+
+	// The windows are loaded once per run
+	ctx := a.withMaintenanceWindows(context.Background())
+	os.Remove(filepath.Join(a.ProgramDir, AGENT_MAINTENANCE_FILE))
+	if w := a.ActiveMaintenance(ctx, CHECK_TYPE_PING); w == nil || w.ID != "local" {
+		t.Errorf("ActiveMaintenance() = %+v, want the window loaded with the run", w)
+	}
+	if w := a.ActiveMaintenance(context.Background(), CHECK_TYPE_PING); w != nil {
+		t.Errorf("ActiveMaintenance() = %+v after the window was removed", w)
+	}
+}
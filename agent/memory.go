@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+// How long page faults are counted to compute their rate
+const MEM_FAULT_SAMPLE = time.Second
+
+// MemoryStats physical memory, swap and commit charge, sizes in bytes
+// UsedPercent is based on the memory available to start new applications, which includes reclaimable cache.
+type MemoryStats struct {
+	Total             uint64  `json:"total"`
+	Available         uint64  `json:"available"`
+	UsedPercent       float64 `json:"used_percent"`
+	SwapTotal         uint64  `json:"swap_total"`
+	SwapUsed          uint64  `json:"swap_used"`
+	SwapPercent       float64 `json:"swap_percent"`
+	CommitLimit       uint64  `json:"commit_limit"`
+	Committed         uint64  `json:"committed"`
+	CommitPercent     float64 `json:"commit_percent"`
+	FaultsPerSec      float64 `json:"page_faults_per_sec"`
+	MajorFaultsPerSec float64 `json:"major_faults_per_sec"` // read from disk
+}
+
+// faultCounters cumulative page faults since boot
+type faultCounters struct {
+	faults uint64
+	major  uint64
+}
+
+// GetMemoryStats returns the memory usage, and the page fault rate sampled over MEM_FAULT_SAMPLE
+func GetMemoryStats(ctx context.Context) (MemoryStats, error) {
+	stats, err := readMemory()
+	if err != nil {
+		return stats, err
+	}
+	stats.setPercents()
+
+	before, err := readFaultCounters()
+	if err != nil {
+		return stats, nil
+	}
+	start := time.Now()
+	if !sleepContext(ctx, MEM_FAULT_SAMPLE) {
+		return stats, nil
+	}
+	after, err := readFaultCounters()
+	if err != nil {
+		return stats, nil
+	}
+	elapsed := time.Since(start).Seconds()
+	stats.FaultsPerSec = counterRate(before.faults, after.faults, elapsed)
+	stats.MajorFaultsPerSec = counterRate(before.major, after.major, elapsed)
+	return stats, nil
+}
+
+func (s *MemoryStats) setPercents() {
+	s.UsedPercent = percentOf(s.Total-s.Available, s.Total)
+	s.SwapPercent = percentOf(s.SwapUsed, s.SwapTotal)
+	s.CommitPercent = percentOf(s.Committed, s.CommitLimit)
+}
+
+// MemoryThresholdsSet returns true when the check has any of the thresholds evaluated by the agent
+// Otherwise the server evaluates the used percent against its own thresholds.
+func MemoryThresholdsSet(data rmm.Check) bool {
+	return data.SwapWarningThreshold > 0 || data.SwapErrorThreshold > 0 ||
+		data.AvailableWarningMB > 0 || data.AvailableErrorMB > 0 ||
+		data.CommitWarningThreshold > 0 || data.CommitErrorThreshold > 0 ||
+		data.MajorFaultWarningRate > 0 || data.MajorFaultErrorRate > 0
+}
+
+// MemoryStatus compares the memory stats to the check's thresholds
+func MemoryStatus(stats MemoryStats, data rmm.Check) (status, severity string) {
+	over := func(value float64, threshold int) bool {
+		return threshold > 0 && value >= float64(threshold)
+	}
+	availableMB := float64(stats.Available) / 1024 / 1024
+	under := func(threshold int) bool {
+		return threshold > 0 && availableMB < float64(threshold)
+	}
+
+	switch {
+	case over(stats.UsedPercent, data.ErrorThreshold),
+		over(stats.SwapPercent, data.SwapErrorThreshold),
+		over(stats.CommitPercent, data.CommitErrorThreshold),
+		over(stats.MajorFaultsPerSec, data.MajorFaultErrorRate),
+		under(data.AvailableErrorMB):
+		return "failing", "error"
+	case over(stats.UsedPercent, data.WarningThreshold),
+		over(stats.SwapPercent, data.SwapWarningThreshold),
+		over(stats.CommitPercent, data.CommitWarningThreshold),
+		over(stats.MajorFaultsPerSec, data.MajorFaultWarningRate),
+		under(data.AvailableWarningMB):
+		return "failing", "warning"
+	}
+	return "passing", ""
+}
+
+// ParseMemInfo reads the memory, swap and commit charge of /proc/meminfo, whose sizes are in kB
+// Kernels older than 3.14 don't report MemAvailable, free memory is used instead.
+func ParseMemInfo(content string) (MemoryStats, error) {
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[name] = v * 1024
+	}
+
+	total, ok := values["MemTotal"]
+	if !ok {
+		return MemoryStats{}, errors.New("MemTotal not found in meminfo")
+	}
+	available, ok := values["MemAvailable"]
+	if !ok {
+		available = values["MemFree"]
+	}
+	return MemoryStats{
+		Total:       total,
+		Available:   available,
+		SwapTotal:   values["SwapTotal"],
+		SwapUsed:    values["SwapTotal"] - values["SwapFree"],
+		CommitLimit: values["CommitLimit"],
+		Committed:   values["Committed_AS"],
+	}, nil
+}
+
+// parseVMStat reads the page fault counters of /proc/vmstat
+func parseVMStat(content string) faultCounters {
+	var c faultCounters
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "pgfault":
+			c.faults = v
+		case "pgmajfault":
+			c.major = v
+		}
+	}
+	return c
+}
+
+func percentOf(part, total uint64) float64 {
+	if total == 0 || part > total {
+		return 0
+	}
+	return float64(part) / float64(total) * 100
+}
+
+// counterRate returns the per second rate of a counter, 0 if it wrapped
+func counterRate(before, after uint64, seconds float64) float64 {
+	if after < before || seconds <= 0 {
+		return 0
+	}
+	return float64(after-before) / seconds
+}
@@ -0,0 +1,19 @@
+package agent
+
+import "os"
+
+func readMemory() (MemoryStats, error) {
+	content, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return MemoryStats{}, err
+	}
+	return ParseMemInfo(string(content))
+}
+
+func readFaultCounters() (faultCounters, error) {
+	content, err := os.ReadFile("/proc/vmstat")
+	if err != nil {
+		return faultCounters{}, err
+	}
+	return parseVMStat(string(content)), nil
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"os"
+	"testing"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func TestParseMemInfo(t *testing.T) {
+	content, err := os.ReadFile("testdata/meminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := ParseMemInfo(string(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MemoryStats{
+		Total:       8038572 * 1024,
+		Available:   2009644 * 1024,
+		SwapTotal:   2097148 * 1024,
+		SwapUsed:    (2097148 - 1572860) * 1024,
+		CommitLimit: 6116432 * 1024,
+		Committed:   9174648 * 1024,
+	}
+	if stats != want {
+		t.Fatalf("ParseMemInfo() = %+v, want %+v", stats, want)
+	}
+
+	stats.setPercents()
+	if got := roundPercent(stats.UsedPercent); got != 75 {
+		t.Errorf("UsedPercent = %v, want 75", got)
+	}
+	if got := roundPercent(stats.SwapPercent); got != 25 {
+		t.Errorf("SwapPercent = %v, want 25", got)
+	}
+	// Overcommitted: the percent can't be computed meaningfully beyond the limit
+	if stats.CommitPercent != 0 {
+		t.Errorf("CommitPercent = %v, want 0", stats.CommitPercent)
+	}
+}
+
+func TestParseMemInfoWithoutMemAvailable(t *testing.T) {
+	stats, err := ParseMemInfo("MemTotal: 1000 kB\nMemFree: 250 kB\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Available != 250*1024 {
+		t.Errorf("Available = %d, want MemFree", stats.Available)
+	}
+
+	if _, err := ParseMemInfo("MemFree: 250 kB\n"); err == nil {
+		t.Error("ParseMemInfo() without MemTotal should fail")
+	}
+}
+
+func TestParseVMStat(t *testing.T) {
+	content, err := os.ReadFile("testdata/vmstat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parseVMStat(string(content))
+	want := faultCounters{faults: 1187394432, major: 94117}
+	if got != want {
+		t.Fatalf("parseVMStat() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCounterRate(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after uint64
+		seconds       float64
+		want          float64
+	}{
+		{"rate", 100, 400, 2, 150},
+		{"unchanged", 100, 100, 1, 0},
+		{"wrapped", 4294967000, 200, 1, 0},
+		{"no elapsed time", 100, 400, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := counterRate(tt.before, tt.after, tt.seconds); got != tt.want {
+			t.Errorf("%s: counterRate() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryStatus(t *testing.T) {
+	stats := MemoryStats{
+		Total:             8 << 30,
+		Available:         512 << 20,
+		UsedPercent:       93.75,
+		SwapPercent:       40,
+		MajorFaultsPerSec: 12,
+	}
+	tests := []struct {
+		name     string
+		check    rmm.Check
+		status   string
+		severity string
+	}{
+		{"no thresholds", rmm.Check{}, "passing", ""},
+		{"used percent warning", rmm.Check{WarningThreshold: 90, ErrorThreshold: 95}, "failing", "warning"},
+		{"used percent error", rmm.Check{ErrorThreshold: 90}, "failing", "error"},
+		{"swap below", rmm.Check{SwapWarningThreshold: 50}, "passing", ""},
+		{"available error", rmm.Check{AvailableErrorMB: 1024}, "failing", "error"},
+		{"available ok", rmm.Check{AvailableWarningMB: 256}, "passing", ""},
+		{"major faults warning", rmm.Check{MajorFaultWarningRate: 10, MajorFaultErrorRate: 100}, "failing", "warning"},
+	}
+	for _, tt := range tests {
+		status, severity := MemoryStatus(stats, tt.check)
+		if status != tt.status || severity != tt.severity {
+			t.Errorf("%s: MemoryStatus() = %s/%s, want %s/%s", tt.name, status, severity, tt.status, tt.severity)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/StackExchange/wmi"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+type win32PerfRawMemory struct {
+	PageFaultsPersec uint32
+	PageReadsPersec  uint32
+}
+
+func readMemory() (MemoryStats, error) {
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return MemoryStats{}, err
+	}
+	stats := MemoryStats{Total: vm.Total, Available: vm.Available}
+
+	// gopsutil reports the commit charge as swap on Windows
+	if commit, err := mem.SwapMemory(); err == nil {
+		stats.CommitLimit = commit.Total
+		stats.Committed = commit.Used
+	}
+	if files, err := mem.SwapDevices(); err == nil {
+		for _, f := range files {
+			stats.SwapTotal += f.UsedBytes + f.FreeBytes
+			stats.SwapUsed += f.UsedBytes
+		}
+	}
+	return stats, nil
+}
+
+// readFaultCounters page faults, and page reads to resolve hard faults
+func readFaultCounters() (faultCounters, error) {
+	var dst []win32PerfRawMemory
+	q := "SELECT PageFaultsPersec, PageReadsPersec FROM Win32_PerfRawData_PerfOS_Memory"
+	if err := wmi.Query(q, &dst); err != nil {
+		return faultCounters{}, err
+	}
+	if len(dst) == 0 {
+		return faultCounters{}, fmt.Errorf("no memory performance counters")
+	}
+	return faultCounters{faults: uint64(dst[0].PageFaultsPersec), major: uint64(dst[0].PageReadsPersec)}, nil
+}
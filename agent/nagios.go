@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nagios plugin return codes
+const (
+	NAGIOS_OK       = 0
+	NAGIOS_WARNING  = 1
+	NAGIOS_CRITICAL = 2
+	NAGIOS_UNKNOWN  = 3
+
+	// Shell under which plugins run by path are checked by the local policy and signed
+	NAGIOS_PLUGIN_SHELL = "plugin"
+)
+
+var (
+	nagiosStates = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+	perfValueRe  = regexp.MustCompile(`^([-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)(.*)$`)
+)
+
+// PerfData a single metric of a plugin's performance data: label=value[UOM];[warn];[crit];[min];[max]
+// Value is nil when the plugin reports it as undetermined (U), Warn and Crit are kept as ranges
+type PerfData struct {
+	Label string   `json:"label"`
+	Value *float64 `json:"value"`
+	UOM   string   `json:"uom,omitempty"`
+	Warn  string   `json:"warn,omitempty"`
+	Crit  string   `json:"crit,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// NagiosResult the interpreted output of a Monitoring Plugins compatible script
+type NagiosResult struct {
+	State      string     `json:"state"`
+	Output     string     `json:"output"`
+	LongOutput string     `json:"long_output,omitempty"`
+	PerfData   []PerfData `json:"perfdata"`
+}
+
+// NagiosStatus maps a plugin return code to a check status and severity
+// Any code outside 0-3 is UNKNOWN
+func NagiosStatus(retcode int) (state, status, severity string) {
+	switch retcode {
+	case NAGIOS_OK:
+		return nagiosStates[retcode], "passing", ""
+	case NAGIOS_WARNING:
+		return nagiosStates[retcode], "failing", "warning"
+	case NAGIOS_CRITICAL:
+		return nagiosStates[retcode], "failing", "error"
+	}
+	return nagiosStates[NAGIOS_UNKNOWN], "failing", "info"
+}
+
+// ParseNagiosOutput splits plugin output into its text, long text and performance data
+//
+//	TEXT OUTPUT | OPTIONAL PERFDATA
+//	LONG TEXT LINE 1
+//	LONG TEXT LINE 2 | PERFDATA
+//	PERFDATA LINE 2
+func ParseNagiosOutput(retcode int, stdout string) NagiosResult {
+	state, _, _ := NagiosStatus(retcode)
+	result := NagiosResult{State: state}
+
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(stdout, "\r\n", "\n"), "\n"), "\n")
+	result.Output = strings.TrimSpace(strings.SplitN(lines[0], "|", 2)[0])
+
+	long := make([]string, 0)
+	for _, line := range lines[1:] {
+		if i := strings.Index(line, "|"); i >= 0 {
+			long = append(long, line[:i])
+			break
+		}
+		long = append(long, line)
+	}
+	result.LongOutput = strings.TrimSpace(strings.Join(long, "\n"))
+
+	perf := NewPerfDataWriter()
+	perf.Write([]byte(stdout))
+	result.PerfData = perf.Close()
+	return result
+}
+
+// PerfDataWriter collects the performance data of a plugin's output as it is written
+// Only the performance data is kept, so it is complete even when the output itself is truncated.
+type PerfDataWriter struct {
+	perfData []PerfData
+	lines    int
+	// the current line follows a "|", or every line does once the long text's "|" was seen
+	pipe   bool
+	inPerf bool
+	line   []byte
+}
+
+// NewPerfDataWriter creates an empty PerfDataWriter
+func NewPerfDataWriter() *PerfDataWriter {
+	return &PerfDataWriter{perfData: make([]PerfData, 0)}
+}
+
+func (w *PerfDataWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.add(p)
+			break
+		}
+		w.add(p[:i])
+		w.endLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// add appends to the current line, dropping any text before its "|"
+func (w *PerfDataWriter) add(b []byte) {
+	if !w.inPerf && !w.pipe {
+		i := bytes.IndexByte(b, '|')
+		if i < 0 {
+			return
+		}
+		w.pipe = true
+		b = b[i+1:]
+	}
+	w.line = append(w.line, b...)
+}
+
+func (w *PerfDataWriter) endLine() {
+	if w.inPerf || w.pipe {
+		w.perfData = append(w.perfData, ParsePerfData(string(w.line))...)
+	}
+	// Every line following the long text's "|" is performance data
+	if w.pipe && w.lines > 0 {
+		w.inPerf = true
+	}
+	w.line = w.line[:0]
+	w.pipe = false
+	w.lines++
+}
+
+// Close parses the last line, when the output doesn't end with a newline, and returns the performance data
+func (w *PerfDataWriter) Close() []PerfData {
+	if len(w.line) > 0 || w.pipe {
+		w.endLine()
+	}
+	return w.perfData
+}
+
+// RunPlugin runs a Monitoring Plugins executable directly with its arguments, also writing its standard output to tee
+// Secrets are only passed as environment variables and are redacted from the output.
+// A plugin that can't be started or times out is UNKNOWN.
+func (a *Agent) RunPlugin(ctx context.Context, path string, args []string, timeout time.Duration, env, secrets map[string]string, tee io.Writer) (stdout, stderr string, retcode int, artifacts []OutputArtifact) {
+	spillDir := ""
+	if a.UploadLargeOutput {
+		spillDir = filepath.Join(os.TempDir(), AGENT_TEMP_DIR)
+		if err := os.MkdirAll(spillDir, 0700); err != nil {
+			spillDir = ""
+		}
+	}
+	outb := NewOutputBuffer(a.MaxOutputBytes, spillDir)
+	errb := NewOutputBuffer(a.MaxOutputBytes, spillDir)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	var closeOutput func()
+	cmd.Stdout, cmd.Stderr, closeOutput = scriptWriters(outb, errb, tee, secrets)
+	if len(env) > 0 || len(secrets) > 0 {
+		// secrets are applied last so they can't be overridden by regular variables
+		cmd.Env = append(os.Environ(), EnvList(env)...)
+		cmd.Env = append(cmd.Env, EnvList(secrets)...)
+	}
+
+	err := cmd.Run()
+	closeOutput()
+	stdout = outb.String()
+	stderr = errb.String()
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		stderr = fmt.Sprintf("%s\nPlugin timed out after %s", stderr, timeout)
+		retcode = NAGIOS_UNKNOWN
+	case errors.As(err, &exitErr):
+		retcode = exitErr.ExitCode()
+	case err != nil:
+		a.Logger.Debugln("Plugin", path, err)
+		stderr = err.Error()
+		retcode = NAGIOS_UNKNOWN
+	}
+	artifacts = a.outputArtifacts(outb, errb)
+	return stdout, stderr, retcode, artifacts
+}
+
+// ParsePerfData parses space separated metrics, labels containing spaces are single quoted
+// Malformed metrics are skipped
+func ParsePerfData(perf string) []PerfData {
+	ret := make([]PerfData, 0)
+	for _, token := range splitPerfData(perf) {
+		eq := strings.LastIndex(token, "=")
+		if eq <= 0 {
+			continue
+		}
+		label := token[:eq]
+		if strings.HasPrefix(label, "'") && strings.HasSuffix(label, "'") && len(label) > 1 {
+			label = strings.ReplaceAll(label[1:len(label)-1], "''", "'")
+		}
+
+		fields := strings.Split(token[eq+1:], ";")
+		pd := PerfData{Label: label}
+		if fields[0] != "U" {
+			m := perfValueRe.FindStringSubmatch(fields[0])
+			if m == nil {
+				continue
+			}
+			v, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				continue
+			}
+			pd.Value = &v
+			pd.UOM = m[2]
+		}
+		if len(fields) > 1 {
+			pd.Warn = fields[1]
+		}
+		if len(fields) > 2 {
+			pd.Crit = fields[2]
+		}
+		if len(fields) > 3 {
+			pd.Min = parsePerfFloat(fields[3])
+		}
+		if len(fields) > 4 {
+			pd.Max = parsePerfFloat(fields[4])
+		}
+		ret = append(ret, pd)
+	}
+	return ret
+}
+
+// splitPerfData splits on whitespace outside single quoted labels
+func splitPerfData(perf string) []string {
+	tokens := make([]string, 0)
+	var (
+		cur    strings.Builder
+		quoted bool
+	)
+	for _, c := range perf {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+			cur.WriteRune(c)
+		case !quoted && (c == ' ' || c == '\t' || c == '\r' || c == '\n'):
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens
+}
+
+func parsePerfFloat(s string) *float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
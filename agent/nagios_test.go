@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNagiosOutput(t *testing.T) {
+	out := "DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968\n" +
+		"/ 15272 MB (77%);\n" +
+		"/boot 68 MB (69%);\n" +
+		"/home 69357 MB (27%);\n" +
+		"/var/log 819 MB (84%); | /boot=68MB;88;93;0;98\n" +
+		"/home=69357MB;253404;253409;0;253414\n" +
+		"/var/log=818MB;970;975;0;980\n"
+
+	result := ParseNagiosOutput(NAGIOS_OK, out)
+	if result.State != "OK" {
+		t.Errorf("State = %s, want OK", result.State)
+	}
+	if result.Output != "DISK OK - free space: / 3326 MB (56%);" {
+		t.Errorf("Output = %q", result.Output)
+	}
+	if !strings.HasPrefix(result.LongOutput, "/ 15272 MB (77%);") || !strings.HasSuffix(result.LongOutput, "/var/log 819 MB (84%);") {
+		t.Errorf("LongOutput = %q", result.LongOutput)
+	}
+
+	labels := make([]string, 0)
+	for _, pd := range result.PerfData {
+		labels = append(labels, pd.Label)
+	}
+	if got := strings.Join(labels, ","); got != "/,/boot,/home,/var/log" {
+		t.Fatalf("perfdata labels = %s", got)
+	}
+	root := result.PerfData[0]
+	if root.Value == nil || *root.Value != 2643 || root.UOM != "MB" || root.Warn != "5948" || root.Crit != "5958" ||
+		root.Min == nil || *root.Min != 0 || root.Max == nil || *root.Max != 5968 {
+		t.Errorf("perfdata / = %+v", root)
+	}
+}
+
+func TestParseNagiosOutputWithoutPerfData(t *testing.T) {
+	result := ParseNagiosOutput(7, "CHECK FAILED\r\nsomething went wrong\r\n")
+	if result.State != "UNKNOWN" || result.Output != "CHECK FAILED" || result.LongOutput != "something went wrong" {
+		t.Errorf("ParseNagiosOutput() = %+v", result)
+	}
+	if len(result.PerfData) != 0 {
+		t.Errorf("PerfData = %+v, want none", result.PerfData)
+	}
+}
+
+func TestParsePerfData(t *testing.T) {
+	perf := ParsePerfData(`time=0.02s;1;2;0 'disk usage'=75%;80;90 'it''s'=3 size=U;; junk =5 bad=abc`)
+	if len(perf) != 4 {
+		t.Fatalf("ParsePerfData() = %+v, want 4 metrics", perf)
+	}
+
+	if perf[0].Label != "time" || *perf[0].Value != 0.02 || perf[0].UOM != "s" || perf[0].Max != nil {
+		t.Errorf("time = %+v", perf[0])
+	}
+	if perf[1].Label != "disk usage" || *perf[1].Value != 75 || perf[1].UOM != "%" || perf[1].Warn != "80" || perf[1].Crit != "90" {
+		t.Errorf("disk usage = %+v", perf[1])
+	}
+	if perf[2].Label != "it's" || *perf[2].Value != 3 {
+		t.Errorf("quoted label = %+v", perf[2])
+	}
+	if perf[3].Label != "size" || perf[3].Value != nil {
+		t.Errorf("undetermined value = %+v", perf[3])
+	}
+}
+
+func TestPerfDataWriterTruncatedOutput(t *testing.T) {
+	// The perfdata follows a long text larger than the agent keeps
+	long := strings.Repeat("line of long text\n", 1000)
+	out := "OK | first=1\n" + long + "last line | second=2\nthird=3"
+
+	outb := NewOutputBuffer(1024, "")
+	perf := NewPerfDataWriter()
+	for _, chunk := range []string{out[:10], out[10:5000], out[5000:]} {
+		outb.Write([]byte(chunk))
+		perf.Write([]byte(chunk))
+	}
+	if !outb.Truncated() {
+		t.Fatal("output was not truncated")
+	}
+
+	got := perf.Close()
+	if len(got) != 3 || got[0].Label != "first" || got[1].Label != "second" || got[2].Label != "third" {
+		t.Errorf("perfdata = %+v, want first, second and third", got)
+	}
+}
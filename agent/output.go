@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	API_URL_ARTIFACTS = "/api/v3/artifacts/"
+
+	// Default per-stream limit, keeps stdout + stderr below the default NATS max payload of 1 MB
+	DEFAULT_MAX_OUTPUT_BYTES = 256 * 1024
+
+	// Size of each uploaded artifact chunk
+	ARTIFACT_CHUNK_SIZE = 512 * 1024
+)
+
+// OutputArtifact references the full output of a stream that was too large to send inline
+type OutputArtifact struct {
+	Name       string `json:"name"`
+	Stream     string `json:"stream"` // stdout, stderr
+	Size       int64  `json:"size"`
+	Compressed int64  `json:"compressed_size"`
+	Chunks     int    `json:"chunks"`
+	SHA256     string `json:"sha256"` // of the compressed artifact
+}
+
+// OutputBuffer captures a stream, keeping only its head and tail once the limit is reached
+// When spilling is enabled, the complete stream is also gzip compressed to a temporary file
+type OutputBuffer struct {
+	limit int
+	head  bytes.Buffer
+	tail  []byte
+	total int64
+
+	spill *os.File
+	gz    *gzip.Writer
+}
+
+// NewOutputBuffer creates a buffer keeping at most limit bytes in memory
+// A limit <= 0 disables truncation
+func NewOutputBuffer(limit int, spillDir string) *OutputBuffer {
+	b := &OutputBuffer{limit: limit}
+	if limit > 0 && spillDir != "" {
+		f, err := ioutil.TempFile(spillDir, "*.out.gz")
+		if err == nil {
+			b.spill = f
+			b.gz = gzip.NewWriter(f)
+		}
+	}
+	return b
+}
+
+func (b *OutputBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += int64(n)
+	if b.gz != nil {
+		if _, err := b.gz.Write(p); err != nil {
+			b.discardSpill()
+		}
+	}
+
+	if b.limit <= 0 {
+		return b.head.Write(p)
+	}
+
+	headLimit := b.limit / 2
+	if room := headLimit - b.head.Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.head.Write(p[:room])
+		p = p[room:]
+	}
+
+	tailLimit := b.limit - headLimit
+	b.tail = append(b.tail, p...)
+	if len(b.tail) > tailLimit {
+		b.tail = append(b.tail[:0], b.tail[len(b.tail)-tailLimit:]...)
+	}
+	return n, nil
+}
+
+// Truncated returns true when part of the stream was dropped
+func (b *OutputBuffer) Truncated() bool {
+	return b.limit > 0 && b.total > int64(b.limit)
+}
+
+// String returns the captured output, with a marker where bytes were dropped
+func (b *OutputBuffer) String() string {
+	if !b.Truncated() {
+		return b.head.String() + string(b.tail)
+	}
+	dropped := b.total - int64(b.head.Len()) - int64(len(b.tail))
+	return fmt.Sprintf("%s\n\n... [%d bytes truncated] ...\n\n%s",
+		strings.ToValidUTF8(b.head.String(), ""), dropped, strings.ToValidUTF8(string(b.tail), ""))
+}
+
+// Close finishes the spill file and returns its path, or an empty string if it isn't needed
+func (b *OutputBuffer) Close() string {
+	if b.gz == nil {
+		return ""
+	}
+	if !b.Truncated() || b.gz.Close() != nil || b.spill.Close() != nil {
+		b.discardSpill()
+		return ""
+	}
+	return b.spill.Name()
+}
+
+func (b *OutputBuffer) discardSpill() {
+	if b.gz == nil {
+		return
+	}
+	b.gz = nil
+	b.spill.Close()
+	os.Remove(b.spill.Name())
+}
+
+// UploadArtifact uploads a compressed output file to the server in chunks
+// The file is read twice, to compute its checksum and then to send each chunk, so it is never held in memory.
+func (a *Agent) UploadArtifact(path, stream string, size int64) (OutputArtifact, error) {
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return OutputArtifact{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	compressed, err := io.Copy(h, f)
+	if err != nil {
+		return OutputArtifact{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return OutputArtifact{}, err
+	}
+
+	artifact := OutputArtifact{
+		Name:       fmt.Sprintf("%s-%d-%s.gz", a.AgentID, time.Now().UnixNano(), stream),
+		Stream:     stream,
+		Size:       size,
+		Compressed: compressed,
+		Chunks:     int((compressed + ARTIFACT_CHUNK_SIZE - 1) / ARTIFACT_CHUNK_SIZE),
+		SHA256:     hex.EncodeToString(h.Sum(nil)),
+	}
+
+	chunk := make([]byte, ARTIFACT_CHUNK_SIZE)
+	for i := 0; i < artifact.Chunks; i++ {
+		n, err := io.ReadFull(f, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return OutputArtifact{}, err
+		}
+
+		r, err := a.rClient.R().
+			SetHeader("Content-Type", "application/octet-stream").
+			SetQueryParams(map[string]string{
+				"agent_id": a.AgentID,
+				"name":     artifact.Name,
+				"chunk":    strconv.Itoa(i),
+				"chunks":   strconv.Itoa(artifact.Chunks),
+				"sha256":   artifact.SHA256,
+			}).
+			SetBody(bytes.NewReader(chunk[:n])).
+			Post(API_URL_ARTIFACTS)
+		if err != nil {
+			return OutputArtifact{}, err
+		}
+		if r.IsError() {
+			return OutputArtifact{}, fmt.Errorf("artifact upload response code: %v", r.StatusCode())
+		}
+	}
+	return artifact, nil
+}
+
+// outputArtifacts uploads the spilled streams and returns references to them
+func (a *Agent) outputArtifacts(stdout, stderr *OutputBuffer) []OutputArtifact {
+	ret := make([]OutputArtifact, 0)
+	streams := []struct {
+		name string
+		buf  *OutputBuffer
+	}{{"stdout", stdout}, {"stderr", stderr}}
+
+	for _, s := range streams {
+		path := s.buf.Close()
+		if path == "" {
+			continue
+		}
+		artifact, err := a.UploadArtifact(path, s.name, s.buf.total)
+		if err != nil {
+			a.Logger.Errorln("Unable to upload", s.name, "artifact:", err)
+			continue
+		}
+		ret = append(ret, artifact)
+	}
+	return ret
+}
+
+// discardOutput removes any spill files without uploading them
+func discardOutput(streams ...*OutputBuffer) {
+	for _, b := range streams {
+		b.discardSpill()
+	}
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestUploadArtifactChunks(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received bytes.Buffer
+		chunks   []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received.Write(body)
+		chunks = append(chunks, r.URL.Query().Get("chunk"))
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t)
+	a.AgentID = "agent"
+	a.rClient = resty.New().SetBaseURL(srv.URL)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*ARTIFACT_CHUNK_SIZE+100)/16)
+	path := filepath.Join(t.TempDir(), "stdout.out.gz")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	artifact, err := a.UploadArtifact(path, "stdout", 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(content)
+	if artifact.Chunks != 3 || len(chunks) != 3 || chunks[2] != "2" {
+		t.Errorf("%d chunks, %d uploaded (%v), want 3", artifact.Chunks, len(chunks), chunks)
+	}
+	if artifact.Compressed != int64(len(content)) || artifact.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("artifact = %+v", artifact)
+	}
+	if !bytes.Equal(received.Bytes(), content) {
+		t.Errorf("uploaded %d bytes, want the %d bytes of the file", received.Len(), len(content))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("artifact file was not removed: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+
+	rmm "github.com/sarog/rmmagent/shared"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	PING_DEFAULT_COUNT = 4
+	PING_MAX_COUNT     = 100
+	PING_INTERVAL      = 1 * time.Second
+	PING_TIMEOUT       = 2 * time.Second
+
+	// IANA protocol numbers, needed to parse replies
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// PingStats results of a series of ICMP echo requests, times are in milliseconds
+type PingStats struct {
+	Host     string  `json:"host"`
+	Addr     string  `json:"addr"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Loss     float64 `json:"loss_percent"`
+	Min      float64 `json:"min_ms"`
+	Avg      float64 `json:"avg_ms"`
+	Max      float64 `json:"max_ms"`
+	Jitter   float64 `json:"jitter_ms"`
+}
+
+func (s PingStats) String() string {
+	if s.Received == 0 {
+		return fmt.Sprintf("%s (%s): %d sent, %d received, %.0f%% loss",
+			s.Host, s.Addr, s.Sent, s.Received, s.Loss)
+	}
+	return fmt.Sprintf("%s (%s): %d sent, %d received, %.0f%% loss, rtt min/avg/max/jitter = %.2f/%.2f/%.2f/%.2f ms",
+		s.Host, s.Addr, s.Sent, s.Received, s.Loss, s.Min, s.Avg, s.Max, s.Jitter)
+}
+
+// Ping sends count ICMP echo requests to a host
+// Unprivileged datagram sockets are used when the OS supports them, otherwise raw sockets
+// Probes stop being sent once ctx is done.
+func Ping(ctx context.Context, host string, count int) (PingStats, error) {
+	stats := PingStats{Host: host}
+	if count <= 0 {
+		count = PING_DEFAULT_COUNT
+	} else if count > PING_MAX_COUNT {
+		count = PING_MAX_COUNT
+	}
+
+	ip, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return stats, err
+	}
+	stats.Addr = ip.String()
+
+	conn, dst, raw, err := listenICMP(ip)
+	if err != nil {
+		return stats, err
+	}
+	defer conn.Close()
+
+	v6 := ip.IP.To4() == nil
+	var (
+		echoType icmp.Type = ipv4.ICMPTypeEcho
+		proto              = protocolICMP
+	)
+	if v6 {
+		echoType, proto = ipv6.ICMPTypeEchoRequest, protocolIPv6ICMP
+	}
+
+	// Each call uses its own ID and sequence numbers, so concurrent pings of the same host don't take
+	// each other's replies. The ID is rewritten by the kernel on datagram sockets, and only checked on raw ones.
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	id := rnd.Intn(0xffff) + 1
+	seqBase := rnd.Intn(0x10000)
+	rtts := make([]float64, 0, count)
+	buf := make([]byte, 1500)
+
+	for i := 0; i < count && ctx.Err() == nil; i++ {
+		start := time.Now()
+		seq := (seqBase + i) & 0xffff
+		msg := icmp.Message{
+			Type: echoType,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("rmmagent-ping")},
+		}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			return stats, err
+		}
+		if _, err := conn.WriteTo(b, dst); err != nil {
+			return stats, err
+		}
+		stats.Sent++
+
+		deadline := start.Add(PING_TIMEOUT)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				// timed out, the probe is lost
+				break
+			}
+			if !sameHost(peer, ip.IP) {
+				continue
+			}
+			reply, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil {
+				continue
+			}
+			echo, ok := reply.Body.(*icmp.Echo)
+			if !ok || echo.Seq != seq || (raw && echo.ID != id) || (reply.Type != ipv4.ICMPTypeEchoReply && reply.Type != ipv6.ICMPTypeEchoReply) {
+				continue
+			}
+			rtts = append(rtts, float64(time.Since(start).Microseconds())/1000)
+			break
+		}
+
+		if i < count-1 && !sleepContext(ctx, time.Until(start.Add(PING_INTERVAL))) {
+			break
+		}
+	}
+
+	stats.Received = len(rtts)
+	if stats.Sent == 0 {
+		return stats, ctx.Err()
+	}
+	stats.Loss = float64(stats.Sent-stats.Received) / float64(stats.Sent) * 100
+	stats.Min, stats.Avg, stats.Max, stats.Jitter = rttStats(rtts)
+	return stats, nil
+}
+
+// PingStatus evaluates the average round trip and the packet loss against the check's thresholds
+// The average is compared to warning_threshold/error_threshold in ms, the loss to the loss thresholds in percent
+func PingStatus(stats PingStats, data rmm.Check) (status, severity string) {
+	over := func(value float64, threshold int) bool {
+		return threshold > 0 && value >= float64(threshold)
+	}
+
+	switch {
+	case stats.Received == 0,
+		over(stats.Loss, data.LossErrorThreshold),
+		over(stats.Avg, data.ErrorThreshold):
+		return "failing", "error"
+	case over(stats.Loss, data.LossWarningThreshold),
+		over(stats.Avg, data.WarningThreshold):
+		return "failing", "warning"
+	}
+	return "passing", ""
+}
+
+// listenICMP opens an ICMP socket for the address family of ip
+// raw is true when the socket is a raw one, which receives every echo reply sent to the host
+func listenICMP(ip *net.IPAddr) (conn *icmp.PacketConn, dst net.Addr, raw bool, err error) {
+	udpNet, rawNet := "udp4", "ip4:icmp"
+	if ip.IP.To4() == nil {
+		udpNet, rawNet = "udp6", "ip6:ipv6-icmp"
+	}
+
+	if conn, err := icmp.ListenPacket(udpNet, ""); err == nil {
+		return conn, &net.UDPAddr{IP: ip.IP, Zone: ip.Zone}, false, nil
+	}
+	conn, err = icmp.ListenPacket(rawNet, "")
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return conn, ip, true, nil
+}
+
+func sameHost(peer net.Addr, ip net.IP) bool {
+	switch p := peer.(type) {
+	case *net.UDPAddr:
+		return p.IP.Equal(ip)
+	case *net.IPAddr:
+		return p.IP.Equal(ip)
+	}
+	return false
+}
+
+// rttStats returns min, avg, max and jitter, the mean difference between consecutive round trips
+func rttStats(rtts []float64) (min, avg, max, jitter float64) {
+	if len(rtts) == 0 {
+		return
+	}
+	min, max = rtts[0], rtts[0]
+	sum := 0.0
+	for i, rtt := range rtts {
+		sum += rtt
+		min = math.Min(min, rtt)
+		max = math.Max(max, rtt)
+		if i > 0 {
+			jitter += math.Abs(rtt - rtts[i-1])
+		}
+	}
+	avg = sum / float64(len(rtts))
+	if len(rtts) > 1 {
+		jitter /= float64(len(rtts) - 1)
+	}
+	return
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const AGENT_POLICY_FILE = "policy.json"
+
+// Policy Locally enforced restrictions on remote operations
+// Loaded from policy.json in the agent's program directory when the agent starts
+type Policy struct {
+	// DisabledFuncs RPC functions the agent refuses to run, e.g. rawcmd, killproc, rebootnow, uninstall
+	DisabledFuncs []string `json:"disabled_funcs"`
+	// AllowedShells shells allowed for rawcmd, recovery commands (cmd) and scripts; empty allows every shell
+	AllowedShells []string `json:"allowed_shells"`
+	// CommandAllow if set, raw and recovery commands and script bodies must match at least one of these regexes
+	CommandAllow []string `json:"command_allow"`
+	// CommandDeny raw and recovery commands and script bodies matching any of these regexes are refused
+	CommandDeny []string `json:"command_deny"`
+
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// PolicyError is returned when an operation is refused by the local policy
+type PolicyError struct {
+	Func   string `json:"func"`
+	Reason string `json:"reason"`
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s refused by local policy: %s", e.Func, e.Reason)
+}
+
+// AgentCapabilities reports what the server is allowed to do on this agent
+type AgentCapabilities struct {
+	Version       string   `json:"version"`
+	DisabledFuncs []string `json:"disabled_funcs"`
+	AllowedShells []string `json:"allowed_shells"`
+	CommandAllow  []string `json:"command_allow"`
+	CommandDeny   []string `json:"command_deny"`
+	ScriptSigning bool     `json:"script_signing"`
+}
+
+// LoadPolicy reads a policy file
+// A missing file results in an empty policy which allows everything
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	for _, expr := range p.CommandAllow {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: command_allow: %s", path, err)
+		}
+		p.allow = append(p.allow, re)
+	}
+
+	for _, expr := range p.CommandDeny {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: command_deny: %s", path, err)
+		}
+		p.deny = append(p.deny, re)
+	}
+	return p, nil
+}
+
+// FuncAllowed checks whether an RPC function may be run
+func (p *Policy) FuncAllowed(fn string) error {
+	for _, f := range p.DisabledFuncs {
+		if strings.EqualFold(f, fn) {
+			return &PolicyError{Func: fn, Reason: "function is disabled"}
+		}
+	}
+	return nil
+}
+
+// CheckCommand checks a shell and a raw command or script body against the policy
+func (p *Policy) CheckCommand(fn, shell, command string) error {
+	if len(p.AllowedShells) > 0 {
+		allowed := false
+		for _, s := range p.AllowedShells {
+			if strings.EqualFold(s, shell) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &PolicyError{Func: fn, Reason: fmt.Sprintf("shell %q is not allowed", shell)}
+		}
+	}
+
+	for _, re := range p.deny {
+		if re.MatchString(command) {
+			return &PolicyError{Func: fn, Reason: fmt.Sprintf("command matches denied pattern %q", re.String())}
+		}
+	}
+
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, re := range p.allow {
+		if re.MatchString(command) {
+			return nil
+		}
+	}
+	return &PolicyError{Func: fn, Reason: "command does not match any allowed pattern"}
+}
+
+// AuthorizeScript runs the local policy and signature checks a script must pass before running
+func (a *Agent) AuthorizeScript(fn, code, shell string, args []string, signature string) error {
+	if err := a.Policy.CheckCommand(fn, shell, code); err != nil {
+		return err
+	}
+	return a.VerifyScript(code, shell, args, signature)
+}
+
+// Capabilities returns the restrictions enforced on this agent
+func (a *Agent) Capabilities() AgentCapabilities {
+	return AgentCapabilities{
+		Version:       a.Version,
+		DisabledFuncs: a.Policy.DisabledFuncs,
+		AllowedShells: a.Policy.AllowedShells,
+		CommandAllow:  a.Policy.CommandAllow,
+		CommandDeny:   a.Policy.CommandDeny,
+		ScriptSigning: a.ScriptSigningEnabled(),
+	}
+}
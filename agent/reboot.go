@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"bufio"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// RebootStatus whether the system needs a reboot, and why
+type RebootStatus struct {
+	Required bool           `json:"required"`
+	Reasons  []RebootReason `json:"reasons"`
+}
+
+// RebootReason a source that requires a reboot, with the packages or services that triggered it when known
+type RebootReason struct {
+	Source   string   `json:"source"`
+	Detail   string   `json:"detail,omitempty"`
+	Packages []string `json:"packages,omitempty"`
+}
+
+func (s *RebootStatus) add(reason RebootReason) {
+	s.Required = true
+	s.Reasons = append(s.Reasons, reason)
+}
+
+// ParseRebootRequiredPkgs parses /var/run/reboot-required.pkgs, one package per line, without duplicates
+func ParseRebootRequiredPkgs(content string) []string {
+	pkgs := make([]string, 0)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		pkg := strings.TrimSpace(scanner.Text())
+		if pkg == "" || seen[pkg] {
+			continue
+		}
+		seen[pkg] = true
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+// ParseNeedsRestarting parses the output of needs-restarting -r, which lists the updated packages as
+//
+//	Core libraries or services have been updated since boot-up:
+//	  * kernel
+//	  * systemd
+func ParseNeedsRestarting(output string) []string {
+	pkgs := make([]string, 0)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "* ") {
+			pkgs = append(pkgs, strings.TrimSpace(line[2:]))
+		}
+	}
+	return pkgs
+}
+
+// InstalledKernels returns the kernel versions of the given /boot/vmlinuz-* paths, newest first
+// Rescue images are ignored.
+func InstalledKernels(images []string) []string {
+	versions := make([]string, 0, len(images))
+	for _, image := range images {
+		version := strings.TrimPrefix(filepath.Base(image), "vmlinuz-")
+		if version == "" || strings.Contains(version, "rescue") {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return CompareVersions(versions[i], versions[j]) > 0
+	})
+	return versions
+}
+
+// CompareVersions compares two package or kernel versions segment by segment, like rpm
+// Numeric segments compare by value and are newer than alphabetic ones, separators are ignored.
+// Returns 1 when a is newer, -1 when b is newer and 0 when they are the same.
+func CompareVersions(a, b string) int {
+	sa, sb := versionSegments(a), versionSegments(b)
+	for i := 0; i < len(sa) && i < len(sb); i++ {
+		x, y := sa[i], sb[i]
+		xNum, yNum := unicode.IsDigit(rune(x[0])), unicode.IsDigit(rune(y[0]))
+		switch {
+		case xNum && !yNum:
+			return 1
+		case !xNum && yNum:
+			return -1
+		case xNum:
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				if len(x) > len(y) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(sa) > len(sb):
+		return 1
+	case len(sa) < len(sb):
+		return -1
+	}
+	return 0
+}
+
+// versionSegments splits a version into runs of digits and runs of letters
+func versionSegments(v string) []string {
+	segments := make([]string, 0)
+	start := -1
+	digits := false
+	for i, c := range v {
+		isDigit, isLetter := unicode.IsDigit(c), unicode.IsLetter(c)
+		if start >= 0 && (!(isDigit || isLetter) || isDigit != digits) {
+			segments = append(segments, v[start:i])
+			start = -1
+		}
+		if start < 0 && (isDigit || isLetter) {
+			start, digits = i, isDigit
+		}
+	}
+	if start >= 0 {
+		segments = append(segments, v[start:])
+	}
+	return segments
+}
+
+// newerKernel returns the newest installed kernel when it is newer than the running one
+func newerKernel(running string, installed []string) (string, bool) {
+	if running == "" || len(installed) == 0 {
+		return "", false
+	}
+	newest := installed[0]
+	return newest, CompareVersions(newest, running) > 0
+}
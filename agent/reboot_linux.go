@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	REBOOT_REQUIRED_FILE = "/var/run/reboot-required"
+	// Timeout of needs-restarting, which queries the package database
+	NEEDS_RESTARTING_TIMEOUT = 60 * time.Second
+)
+
+// SystemRebootRequired checks whether a system reboot is required.
+func (a *Agent) SystemRebootRequired() (bool, error) {
+	status, err := a.GetRebootStatus()
+	return status.Required, err
+}
+
+// GetRebootStatus checks the Debian reboot-required flag, needs-restarting on RHEL-likes,
+// and whether a newer kernel than the running one is installed
+func (a *Agent) GetRebootStatus() (RebootStatus, error) {
+	status := RebootStatus{Reasons: make([]RebootReason, 0)}
+
+	if _, err := os.Stat(REBOOT_REQUIRED_FILE); err == nil {
+		reason := RebootReason{Source: "reboot-required"}
+		if content, err := os.ReadFile(REBOOT_REQUIRED_FILE + ".pkgs"); err == nil {
+			reason.Packages = ParseRebootRequiredPkgs(string(content))
+		}
+		status.add(reason)
+	}
+
+	if path, err := exec.LookPath("needs-restarting"); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), NEEDS_RESTARTING_TIMEOUT)
+		out, err := exec.CommandContext(ctx, path, "-r").Output()
+		cancel()
+		// Exits with 1 when a reboot is required
+		var exitErr *exec.ExitError
+		switch {
+		case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+			status.add(RebootReason{Source: "needs-restarting", Packages: ParseNeedsRestarting(string(out))})
+		case err != nil:
+			a.Logger.Debugln("needs-restarting:", err)
+		}
+	}
+
+	running, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return status, err
+	}
+	images, _ := filepath.Glob("/boot/vmlinuz-*")
+	if newest, ok := newerKernel(strings.TrimSpace(string(running)), InstalledKernels(images)); ok {
+		status.add(RebootReason{
+			Source:   "kernel",
+			Detail:   "running " + strings.TrimSpace(string(running)) + ", installed " + newest,
+			Packages: []string{"kernel"},
+		})
+	}
+	return status, nil
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"5.15.0-91-generic", "5.15.0-91-generic", 0},
+		{"5.15.0-92-generic", "5.15.0-91-generic", 1},
+		{"5.15.0-91-generic", "5.15.0-101-generic", -1},
+		{"6.1.0", "5.19.17", 1},
+		{"5.14.0-362.8.1.el9_3.x86_64", "5.14.0-362.13.1.el9_3.x86_64", -1},
+		{"5.14.0-362.8.1.el9_3.x86_64", "5.14.0-362.8.1.el9_3.x86_64", 0},
+		// leading zeros and separators are ignored
+		{"1.010", "1.10", 0},
+		{"1.0-1", "1.0.1", 0},
+		// numeric segments are newer than alphabetic ones
+		{"1.0.1", "1.0.rc1", 1},
+		// more segments is newer
+		{"4.18.0-1", "4.18.0", 1},
+		{"4.18", "4.18.0", -1},
+		{"1.0a", "1.0b", -1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestInstalledKernels(t *testing.T) {
+	images := []string{
+		"/boot/vmlinuz-5.15.0-91-generic",
+		"/boot/vmlinuz-0-rescue-3f2b1c0d9e8a4b7c",
+		"/boot/vmlinuz-5.15.0-101-generic",
+		"/boot/vmlinuz-5.15.0-92-generic",
+		"/boot/vmlinuz-",
+	}
+	want := []string{"5.15.0-101-generic", "5.15.0-92-generic", "5.15.0-91-generic"}
+	if got := InstalledKernels(images); !reflect.DeepEqual(got, want) {
+		t.Errorf("InstalledKernels() = %v, want %v", got, want)
+	}
+	if got := InstalledKernels(nil); len(got) != 0 {
+		t.Errorf("InstalledKernels(nil) = %v, want none", got)
+	}
+}
+
+func TestNewerKernel(t *testing.T) {
+	installed := []string{"5.15.0-101-generic", "5.15.0-92-generic"}
+	if newest, ok := newerKernel("5.15.0-92-generic", installed); !ok || newest != "5.15.0-101-generic" {
+		t.Errorf("newerKernel() = %s, %v, want 5.15.0-101-generic, true", newest, ok)
+	}
+	if _, ok := newerKernel("5.15.0-101-generic", installed); ok {
+		t.Error("newerKernel() when running the newest kernel should be false")
+	}
+	if _, ok := newerKernel("5.15.0-101-generic", nil); ok {
+		t.Error("newerKernel() without installed kernels should be false")
+	}
+}
+
+func TestParseNeedsRestarting(t *testing.T) {
+	output := `Core libraries or services have been updated since boot-up:
+  * glibc
+  * kernel
+  * systemd
+
+Reboot is required to fully utilize these updates.
+More information: https://access.redhat.com/solutions/27943
+`
+	want := []string{"glibc", "kernel", "systemd"}
+	if got := ParseNeedsRestarting(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseNeedsRestarting() = %v, want %v", got, want)
+	}
+
+	output = "No core libraries or services have been updated since boot-up.\nReboot should not be necessary.\n"
+	if got := ParseNeedsRestarting(output); len(got) != 0 {
+		t.Errorf("ParseNeedsRestarting() = %v, want none", got)
+	}
+}
+
+func TestParseRebootRequiredPkgs(t *testing.T) {
+	want := []string{"linux-image-5.15.0-92-generic", "libc6"}
+	got := ParseRebootRequiredPkgs("linux-image-5.15.0-92-generic\nlibc6\n\nlibc6\n")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseRebootRequiredPkgs() = %v, want %v", got, want)
+	}
+}
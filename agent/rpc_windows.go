@@ -1,14 +1,17 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"sync/atomic"
 	"time"
 
 	nats "github.com/nats-io/nats.go"
+	rmm "github.com/sarog/rmmagent/shared"
 	"github.com/ugorji/go/codec"
 )
 
@@ -24,6 +27,23 @@ type NatsMsg struct {
 	UpdateGUIDs     []string          `json:"guids"`
 	ChocoProgName   string            `json:"choco_prog_name"`
 	PendingActionPK int               `json:"pending_action_pk"`
+	Env             map[string]string `json:"env"`
+	Secrets         map[string]string `json:"secrets"`
+	Signature       string            `json:"signature"`
+	User            string            `json:"user"` // user that initiated the action on the server, if supplied
+
+	MaintenanceWindows []rmm.MaintenanceWindow `json:"maintenance_windows"`
+}
+
+// rpcNoReply functions that never respond to the server, and are recorded when dispatched
+// runtask doesn't respond either, it is recorded once the task has run.
+var rpcNoReply = map[string]struct{}{
+	NATS_CMD_SYNC:               {},
+	NATS_CMD_WMI:                {},
+	NATS_CMD_INSTALL_PYTHON:     {},
+	NATS_CMD_INSTALL_CHOCO:      {},
+	NATS_CMD_GETWINUPDATES:      {},
+	NATS_CMD_INSTALL_WINUPDATES: {},
 }
 
 var (
@@ -32,45 +52,10 @@ var (
 	installWinUpdateLocker uint32
 )
 
-const (
-	NATS_CMD_AGENT_UNINSTALL    = "uninstall"
-	NATS_CMD_AGENT_UPDATE       = "agentupdate"
-	NATS_CMD_CHOCO_INSTALL      = "installwithchoco"
-	NATS_CMD_CPULOADAVG         = "cpuloadavg"
-	NATS_CMD_EVENTLOG           = "eventlog"
-	NATS_CMD_GETWINUPDATES      = "getwinupdates"
-	NATS_CMD_INSTALL_CHOCO      = "installchoco"
-	NATS_CMD_INSTALL_PYTHON     = "installpython"
-	NATS_CMD_INSTALL_WINUPDATES = "installwinupdates"
-	NATS_CMD_PING               = "ping"
-	NATS_CMD_PROCS_KILL         = "killproc"
-	NATS_CMD_PROCS_LIST         = "procs"
-	NATS_CMD_PUBLICIP           = "publicip"
-	NATS_CMD_RAWCMD             = "rawcmd"
-	NATS_CMD_REBOOT_NEEDED      = "needsreboot"
-	NATS_CMD_REBOOT_NOW         = "rebootnow"
-	NATS_CMD_RECOVER            = "recover"
-	NATS_CMD_RUNCHECKS          = "runchecks"
-	NATS_CMD_SCRIPT_RUN         = "runscript"
-	NATS_CMD_SCRIPT_RUN_FULL    = "runscriptfull"
-	NATS_CMD_SOFTWARE_LIST      = "softwarelist"
-	NATS_CMD_SYNC               = "sync"
-	NATS_CMD_SYSINFO            = "sysinfo"
-	NATS_CMD_TASK_ADD           = "schedtask"
-	NATS_CMD_TASK_DEL           = "delschedtask"
-	NATS_CMD_TASK_ENABLE        = "enableschedtask"
-	NATS_CMD_TASK_LIST          = "listschedtasks"
-	NATS_CMD_TASK_RUN           = "runtask"
-	NATS_CMD_WINSERVICES        = "winservices"
-	NATS_CMD_WINSVC_ACTION      = "winsvcaction"
-	NATS_CMD_WINSVC_DETAIL      = "winsvcdetail"
-	NATS_CMD_WINSVC_EDIT        = "editwinsvc"
-	NATS_CMD_WMI                = "wmi"
-)
-
 // RunRPCService handles incoming NATS payloads from server
 func (a *Agent) RunRPCService() {
 	a.Logger.Infoln("RPC service started")
+	go a.cpu.Run()
 	opts := a.setupNatsOptions()
 	server := fmt.Sprintf("tls://%s:%d", a.ApiURL, a.ApiPort)
 	nc, err := nats.Connect(server, opts...)
@@ -78,19 +63,44 @@ func (a *Agent) RunRPCService() {
 		a.Logger.Fatalln(err)
 	}
 
+	journal, err := OpenAuditJournal(filepath.Join(a.ProgramDir, AGENT_AUDIT_FILE))
+	if err != nil {
+		a.Logger.Errorln("Unable to open audit journal:", err)
+	}
+
 	// Incoming payload from server
-	nc.Subscribe(a.AgentID, func(msg *nats.Msg) {
+	nc.Subscribe(a.AgentID, func(nmsg *nats.Msg) {
 		a.Logger.SetOutput(os.Stdout)
+		started := time.Now()
 		var payload *NatsMsg
 		var mh codec.MsgpackHandle
 		mh.RawToString = true
 
-		dec := codec.NewDecoderBytes(msg.Data, &mh)
+		dec := codec.NewDecoderBytes(nmsg.Data, &mh)
 		if err := dec.Decode(&payload); err != nil {
 			a.Logger.Errorln(err)
+			journal.Record(nil, nmsg.Data, nil, started, AUDIT_STATUS_INVALID, nil)
+			return
+		}
+
+		// Every response is recorded in the audit journal
+		msg := &auditedMsg{Msg: nmsg, journal: journal, payload: payload, started: started}
+
+		if err := a.Policy.FuncAllowed(payload.Func); err != nil {
+			a.Logger.Warnln(err)
+			var resp []byte
+			ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+			ret.Encode(err.Error())
+			nmsg.Respond(resp)
+			journal.Record(payload, nmsg.Data, resp, started, AUDIT_STATUS_DENIED, nil)
 			return
 		}
 
+		// Functions without a reply are recorded when dispatched
+		if _, ok := rpcNoReply[payload.Func]; ok {
+			journal.Record(payload, nmsg.Data, nil, started, AUDIT_STATUS_DISPATCHED, nil)
+		}
+
 		switch payload.Func {
 		case NATS_CMD_PING:
 			// 2021-12-31:
@@ -115,8 +125,10 @@ func (a *Agent) RunRPCService() {
 				if err != nil {
 					a.Logger.Errorln(err.Error())
 					ret.Encode(err.Error())
+					msg.Outcome(AUDIT_STATUS_ERROR, nil)
 				} else if !success {
 					ret.Encode("Something went wrong")
+					msg.Outcome(AUDIT_STATUS_ERROR, nil)
 				} else {
 					ret.Encode("ok")
 				}
@@ -136,6 +148,7 @@ func (a *Agent) RunRPCService() {
 				} else {
 					ret.Encode("ok")
 				}
+				msg.Outcome(errorStatus(err), nil)
 				msg.Respond(resp)
 			}(payload)
 
@@ -153,6 +166,7 @@ func (a *Agent) RunRPCService() {
 				} else {
 					ret.Encode("ok")
 				}
+				msg.Outcome(errorStatus(err), nil)
 				msg.Respond(resp)
 			}(payload)
 
@@ -203,6 +217,7 @@ func (a *Agent) RunRPCService() {
 				} else {
 					ret.Encode("ok")
 				}
+				msg.Outcome(errorStatus(err), nil)
 				msg.Respond(resp)
 			}(payload)
 
@@ -211,8 +226,16 @@ func (a *Agent) RunRPCService() {
 			go func(p *NatsMsg) {
 				var resp []byte
 				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				out, _ := CMDShell(p.Data["shell"], []string{}, p.Data["command"], p.Timeout, false)
+				if err := a.AuthorizeScript(p.Func, p.Data["command"], p.Data["shell"], []string{}, p.Signature); err != nil {
+					a.Logger.Errorln(err)
+					ret.Encode(err.Error())
+					msg.Outcome(AUDIT_STATUS_DENIED, nil)
+					msg.Respond(resp)
+					return
+				}
+				out, err := CMDShell(p.Data["shell"], []string{}, p.Data["command"], p.Timeout, false)
 				a.Logger.Debugln(out)
+				msg.Outcome(commandOutcome(err))
 				if out[1] != "" {
 					ret.Encode(out[1])
 				} else {
@@ -272,12 +295,24 @@ func (a *Agent) RunRPCService() {
 				var resp []byte
 				var retData string
 				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				stdout, stderr, _, err := a.RunScript(p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout)
+				if err := a.AuthorizeScript(p.Func, p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Signature); err != nil {
+					a.Logger.Errorln(err)
+					ret.Encode(err.Error())
+					msg.Outcome(AUDIT_STATUS_DENIED, nil)
+					msg.Respond(resp)
+					return
+				}
+				stdout, stderr, retcode, artifacts, err := a.RunScriptEnv(context.Background(), p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.Env, p.Secrets)
 				if err != nil {
 					a.Logger.Debugln(err)
 					retData = err.Error()
+					msg.Outcome(AUDIT_STATUS_ERROR, nil)
 				} else {
+					msg.Outcome(AUDIT_STATUS_OK, &retcode)
 					retData = stdout + stderr
+					for _, artifact := range artifacts {
+						retData += fmt.Sprintf("\n[full %s uploaded as artifact %s]", artifact.Stream, artifact.Name)
+					}
 				}
 				a.Logger.Debugln(retData)
 				ret.Encode(retData)
@@ -289,14 +324,32 @@ func (a *Agent) RunRPCService() {
 			go func(p *NatsMsg) {
 				var resp []byte
 				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+				type ScriptResult struct {
+					Stdout    string                `json:"stdout"`
+					Stderr    string                `json:"stderr"`
+					Retcode   int                   `json:"retcode"`
+					ExecTime  float64               `json:"execution_time"`
+					Artifacts []OutputArtifact      `json:"artifacts,omitempty"`
+					SigError  *ScriptSignatureError `json:"signature_error,omitempty"`
+					PolError  *PolicyError          `json:"policy_error,omitempty"`
+				}
+				if verr := a.AuthorizeScript(p.Func, p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Signature); verr != nil {
+					a.Logger.Errorln(verr)
+					sigErr, _ := verr.(*ScriptSignatureError)
+					polErr, _ := verr.(*PolicyError)
+					ret.Encode(ScriptResult{Stderr: verr.Error(), Retcode: SCRIPT_EXIT_UNVERIFIED, SigError: sigErr, PolError: polErr})
+					msg.Outcome(AUDIT_STATUS_DENIED, nil)
+					msg.Respond(resp)
+					return
+				}
 				start := time.Now()
-				out, err, retcode, _ := a.RunScript(p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout)
-				retData := struct {
-					Stdout   string  `json:"stdout"`
-					Stderr   string  `json:"stderr"`
-					Retcode  int     `json:"retcode"`
-					ExecTime float64 `json:"execution_time"`
-				}{out, err, retcode, time.Since(start).Seconds()}
+				out, err, retcode, artifacts, runErr := a.RunScriptEnv(context.Background(), p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.Env, p.Secrets)
+				retData := ScriptResult{Stdout: out, Stderr: err, Retcode: retcode, ExecTime: time.Since(start).Seconds(), Artifacts: artifacts}
+				if runErr != nil {
+					msg.Outcome(AUDIT_STATUS_ERROR, &retcode)
+				} else {
+					msg.Outcome(AUDIT_STATUS_OK, &retcode)
+				}
 				a.Logger.Debugln(retData)
 				ret.Encode(retData)
 				msg.Respond(resp)
@@ -326,13 +379,19 @@ func (a *Agent) RunRPCService() {
 				msg.Respond(resp)
 			}(payload)
 
-		case "recoverycmd": // 2022-01-01: removed or merged
+		case NATS_CMD_RECOVERY_CMD: // 2022-01-01: removed or merged
 			go func(p *NatsMsg) {
 				var resp []byte
 				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				ret.Encode("ok")
+				err := a.RecoverCMD(p.RecoveryCommand, p.Signature)
+				if err != nil {
+					a.Logger.Errorln(err)
+					ret.Encode(err.Error())
+				} else {
+					ret.Encode("ok")
+				}
+				msg.Outcome(refusalStatus(err), nil)
 				msg.Respond(resp)
-				a.RecoverCMD(p.RecoveryCommand)
 			}(payload)
 
 		case NATS_CMD_SOFTWARE_LIST:
@@ -355,8 +414,10 @@ func (a *Agent) RunRPCService() {
 				var resp []byte
 				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
 				ret.Encode("ok")
+				msg.Defer()
 				msg.Respond(resp)
-				_, _ = CMD("shutdown.exe", []string{"/r", "/t", "5", "/f"}, 15, false)
+				_, err := CMD("shutdown.exe", []string{"/r", "/t", "5", "/f"}, 15, false)
+				msg.Finish(commandOutcome(err))
 			}()
 
 		case NATS_CMD_REBOOT_NEEDED: // 2022-01-01: removed or merged
@@ -375,6 +436,18 @@ func (a *Agent) RunRPCService() {
 				msg.Respond(resp)
 			}()
 
+		case NATS_CMD_REBOOT_REASONS:
+			go func() {
+				var resp []byte
+				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+				status, err := a.GetRebootStatus()
+				if err != nil {
+					a.Logger.Debugln("Error checking if a reboot is needed:", err)
+				}
+				ret.Encode(status)
+				msg.Respond(resp)
+			}()
+
 		case NATS_CMD_SYSINFO:
 			// 2022-01-01: api/tacticalrmm/apiv3/views.py:358
 			go func() {
@@ -419,25 +492,86 @@ func (a *Agent) RunRPCService() {
 			go func() {
 				var resp []byte
 				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				if a.ChecksRunning() {
+				if a.LockHeld(LOCK_CHECKS) {
 					ret.Encode("busy")
 					msg.Respond(resp)
 					a.Logger.Debugln("Checks are already running, please wait")
 				} else {
 					ret.Encode("ok")
+					msg.Defer()
 					msg.Respond(resp)
 					a.Logger.Debugln("Running checks")
 					_, checkerr := CMD(a.EXE, []string{"-m", "runchecks"}, 600, false)
 					if checkerr != nil {
 						a.Logger.Errorln("RPC RunChecks", checkerr)
 					}
+					msg.Finish(commandOutcome(checkerr))
 				}
 			}()
 
+		case NATS_CMD_CAPABILITIES:
+			go func() {
+				var resp []byte
+				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+				caps := a.Capabilities()
+				a.Logger.Debugln(caps)
+				ret.Encode(caps)
+				msg.Respond(resp)
+			}()
+
+		case NATS_CMD_AUDIT_EXPORT:
+			go func(p *NatsMsg) {
+				var resp []byte
+				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+				from, _ := strconv.ParseUint(p.Data["from"], 10, 64)
+				to, _ := strconv.ParseUint(p.Data["to"], 10, 64)
+				since, _ := time.Parse(time.RFC3339, p.Data["since"])
+				until, _ := time.Parse(time.RFC3339, p.Data["until"])
+				entries, err := ExportAuditJournal(filepath.Join(a.ProgramDir, AGENT_AUDIT_FILE), from, to, since, until)
+				if err != nil {
+					a.Logger.Errorln(err)
+					ret.Encode(err.Error())
+				} else {
+					ret.Encode(entries)
+				}
+				msg.Respond(resp)
+			}(payload)
+
+		case NATS_CMD_MAINTENANCE_GET:
+			go func() {
+				var resp []byte
+				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+				windows, err := a.GetMaintenanceWindows()
+				if err != nil {
+					a.Logger.Errorln(err)
+					ret.Encode(err.Error())
+				} else {
+					ret.Encode(windows)
+				}
+				msg.Respond(resp)
+			}()
+
+		case NATS_CMD_MAINTENANCE_SET:
+			go func(p *NatsMsg) {
+				var resp []byte
+				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+				err := a.SetMaintenanceWindows(p.MaintenanceWindows)
+				if err != nil {
+					a.Logger.Errorln(err)
+					ret.Encode(err.Error())
+				} else {
+					ret.Encode("ok")
+				}
+				msg.Outcome(errorStatus(err), nil)
+				msg.Respond(resp)
+			}(payload)
+
 		case NATS_CMD_TASK_RUN:
 			go func(p *NatsMsg) {
 				a.Logger.Debugln("Running task")
-				a.RunTask(p.TaskPK)
+				msg.Defer()
+				exitCode, err := a.RunTask(p.TaskPK)
+				msg.Finish(refusalStatus(err), exitCode)
 			}(payload)
 
 		case NATS_CMD_PUBLICIP:
@@ -476,8 +610,10 @@ func (a *Agent) RunRPCService() {
 				var resp []byte
 				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
 				ret.Encode("ok")
+				msg.Defer()
 				msg.Respond(resp)
-				out, _ := a.InstallWithChoco(p.ChocoProgName)
+				out, err := a.InstallWithChoco(p.ChocoProgName)
+				msg.Finish(errorStatus(err), nil)
 				results := map[string]string{"results": out}
 				url := fmt.Sprintf("/api/v3/%d/chocoresult/", p.PendingActionPK)
 				a.rClient.R().SetBody(results).Patch(url)
@@ -525,9 +661,11 @@ func (a *Agent) RunRPCService() {
 					msg.Respond(resp)
 				} else {
 					ret.Encode("ok")
+					msg.Defer()
 					msg.Respond(resp)
 					a.AgentUpdate(p.Data["url"], p.Data["inno"], p.Data["version"])
 					atomic.StoreUint32(&agentUpdateLocker, 0)
+					msg.Finish(AUDIT_STATUS_OK, nil)
 					nc.Flush()
 					nc.Close()
 					os.Exit(0)
@@ -540,12 +678,17 @@ func (a *Agent) RunRPCService() {
 				var resp []byte
 				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
 				ret.Encode("ok")
+				msg.Defer()
 				msg.Respond(resp)
 				a.AgentUninstall()
+				msg.Finish(AUDIT_STATUS_OK, nil)
 				nc.Flush()
 				nc.Close()
 				os.Exit(0)
 			}()
+
+		default:
+			journal.Record(payload, nmsg.Data, nil, started, AUDIT_STATUS_UNKNOWN, nil)
 		}
 	})
 	nc.Flush()
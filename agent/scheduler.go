@@ -0,0 +1,283 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+const (
+	// How often check definitions are fetched from the server
+	CHECK_REFRESH_INTERVAL = 60
+
+	// The refresh interval doubles up to this while the definitions don't change
+	CHECK_REFRESH_MAX_INTERVAL = 120
+
+	// Used when the server doesn't send an interval
+	DEFAULT_CHECK_INTERVAL = 120
+
+	// Upper bound of the random delay added to every run, in seconds
+	CHECK_MAX_JITTER = 15
+
+	// How often the checks that ran since the last summary are reported, in seconds
+	CHECK_SUMMARY_INTERVAL = 60
+)
+
+// scheduledCheck a cached check definition and its next run time
+type scheduledCheck struct {
+	check    rmm.Check
+	hash     string
+	interval time.Duration
+	next     time.Time
+	// the check's last run hasn't exited yet
+	running bool
+}
+
+// CheckScheduler runs every check on its own interval within the agent service
+type CheckScheduler struct {
+	agent    *Agent
+	mu       sync.Mutex
+	checks   map[int]*scheduledCheck
+	interval int
+	// serial slots and a slot per concurrent check, shared by every run
+	serial map[string]chan struct{}
+	slots  chan struct{}
+	// runs since the last summary
+	records []CheckRunRecord
+	// identify the last definitions received, to skip unchanged responses
+	etag     string
+	bodyHash string
+}
+
+// NewCheckScheduler creates an empty scheduler
+func (a *Agent) NewCheckScheduler() *CheckScheduler {
+	concurrency := a.CheckConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &CheckScheduler{
+		agent:    a,
+		checks:   make(map[int]*scheduledCheck),
+		interval: DEFAULT_CHECK_INTERVAL,
+		serial:   newSerialSlots(),
+		slots:    make(chan struct{}, concurrency),
+	}
+}
+
+// Run refreshes the check definitions and starts the checks that are due, forever
+// Refreshes back off while the definitions don't change, and whenever the server can't be reached.
+func (s *CheckScheduler) Run() {
+	delay := CHECK_REFRESH_INTERVAL * time.Second
+	refresh := time.NewTimer(0)
+	tick := time.NewTicker(time.Second)
+	summary := time.NewTicker(CHECK_SUMMARY_INTERVAL * time.Second)
+
+	for {
+		select {
+		case <-refresh.C:
+			changed, err := s.Refresh()
+			if err != nil {
+				s.agent.Logger.Debugln("CheckScheduler refresh:", err)
+			}
+			delay = nextRefreshDelay(delay, changed && err == nil)
+			refresh.Reset(delay)
+		case now := <-tick.C:
+			s.runDue(now)
+		case <-summary.C:
+			s.sendSummary()
+		}
+	}
+}
+
+// nextRefreshDelay returns the base interval after a change, otherwise doubles delay up to CHECK_REFRESH_MAX_INTERVAL
+func nextRefreshDelay(delay time.Duration, changed bool) time.Duration {
+	if changed {
+		return CHECK_REFRESH_INTERVAL * time.Second
+	}
+	delay *= 2
+	if delay > CHECK_REFRESH_MAX_INTERVAL*time.Second {
+		delay = CHECK_REFRESH_MAX_INTERVAL * time.Second
+	}
+	return delay
+}
+
+// Refresh fetches the check definitions and updates the schedule, returning whether they changed
+// The server's ETag is sent back with If-None-Match, a 304 or an identical body leaves the schedule untouched.
+// New and modified checks are scheduled within the jitter window, removed checks are dropped
+func (s *CheckScheduler) Refresh() (bool, error) {
+	s.mu.Lock()
+	etag := s.etag
+	s.mu.Unlock()
+
+	// 2021-12-31: api.tacticalrmm.apiv3.views.CheckRunner.get
+	req := s.agent.rClient.R()
+	if etag != "" {
+		req.SetHeader("If-None-Match", etag)
+	}
+	r, err := req.Get(fmt.Sprintf("/api/v3/%s/checkrunner/", s.agent.AgentID))
+	if err != nil {
+		return false, err
+	}
+	if r.StatusCode() == http.StatusNotModified {
+		return false, nil
+	}
+	if r.IsError() {
+		return false, fmt.Errorf("checkrunner response code: %v", r.StatusCode())
+	}
+
+	sum := sha256.Sum256(r.Body())
+	bodyHash := hex.EncodeToString(sum[:])
+	s.mu.Lock()
+	unchanged := bodyHash == s.bodyHash
+	if unchanged {
+		s.etag = r.Header().Get("ETag")
+	}
+	s.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data := rmm.AllChecks{}
+	if err := json.Unmarshal(r.Body(), &data); err != nil {
+		return false, err
+	}
+	s.agent.syncMaintenanceWindows(data.MaintenanceWindows)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.etag = r.Header().Get("ETag")
+	s.bodyHash = bodyHash
+
+	if data.Interval > 0 {
+		s.interval = data.Interval
+	}
+
+	now := time.Now()
+	seen := make(map[int]bool, len(data.Checks))
+	for _, check := range data.Checks {
+		seen[check.CheckPK] = true
+		hash := checkHash(check)
+		interval := s.checkInterval(check)
+
+		sc, ok := s.checks[check.CheckPK]
+		if ok && sc.hash == hash {
+			if sc.interval != interval {
+				sc.next = sc.next.Add(interval - sc.interval)
+				sc.interval = interval
+			}
+			continue
+		}
+
+		if !ok {
+			sc = &scheduledCheck{}
+			s.checks[check.CheckPK] = sc
+			s.agent.Logger.Debugln("CheckScheduler added check", check.CheckPK, check.CheckType)
+		} else {
+			s.agent.Logger.Debugln("CheckScheduler updated check", check.CheckPK, check.CheckType)
+		}
+		sc.check = check
+		sc.hash = hash
+		sc.interval = interval
+		sc.next = now.Add(jitter(interval))
+	}
+
+	for pk := range s.checks {
+		if !seen[pk] {
+			s.agent.Logger.Debugln("CheckScheduler removed check", pk)
+			delete(s.checks, pk)
+		}
+	}
+	return true, nil
+}
+
+// runDue starts the checks whose next run time has passed
+// Every check runs on its own, a check is not started again until its last run has exited.
+func (s *CheckScheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sc := range s.checks {
+		if sc.running || now.Before(sc.next) {
+			continue
+		}
+		sc.running = true
+		go s.run(sc, sc.check)
+	}
+}
+
+// run runs a check once a concurrency slot is free, then schedules its next run
+// The slot is held until the check exits, even after it timed out.
+func (s *CheckScheduler) run(sc *scheduledCheck, check rmm.Check) {
+	s.slots <- struct{}{}
+	ctx := s.agent.withMaintenanceWindows(context.Background())
+	rec, finished := s.agent.runCheckTimeout(ctx, check, s.serial[check.CheckType], s.agent.rClient)
+	<-finished
+	<-s.slots
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc.running = false
+	sc.next = time.Now().Add(sc.interval + jitter(sc.interval))
+	s.records = append(s.records, rec)
+}
+
+// sendSummary reports the checks that ran since the last summary
+func (s *CheckScheduler) sendSummary() {
+	s.mu.Lock()
+	records := s.records
+	s.records = nil
+	s.mu.Unlock()
+	if len(records) == 0 {
+		return
+	}
+
+	summary := CheckRunSummary{
+		AgentID:     s.agent.AgentID,
+		Started:     records[0].Started,
+		Finished:    time.Now().UTC(),
+		Concurrency: cap(s.slots),
+		Checks:      records,
+	}
+	for _, rec := range records {
+		if rec.Started.Before(summary.Started) {
+			summary.Started = rec.Started
+		}
+	}
+	s.agent.sendCheckRunSummary(summary)
+}
+
+// checkInterval returns the check's own interval, or the agent's when it doesn't have one
+func (s *CheckScheduler) checkInterval(check rmm.Check) time.Duration {
+	if check.RunInterval > 0 {
+		return time.Duration(check.RunInterval) * time.Second
+	}
+	return time.Duration(s.interval) * time.Second
+}
+
+// jitter returns a random delay of at most a tenth of the interval, capped to CHECK_MAX_JITTER
+func jitter(interval time.Duration) time.Duration {
+	max := int(interval.Milliseconds() / 10)
+	if max > CHECK_MAX_JITTER*1000 {
+		max = CHECK_MAX_JITTER * 1000
+	}
+	if max < 2 {
+		return 0
+	}
+	return time.Duration(randRange(1, max)) * time.Millisecond
+}
+
+// checkHash identifies a check definition, so modified checks can be detected
+// The status is excluded since it changes with every result
+func checkHash(check rmm.Check) string {
+	check.Status = ""
+	b, _ := json.Marshal(check)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+func TestSchedulerRefreshETag(t *testing.T) {
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"check_interval": 300, "Checks": [{"id": 1, "check_type": "ping"}, {"id": 2, "check_type": "cpuload"}]}`))
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t)
+	a.AgentID = "agent"
+	a.rClient = resty.New().SetBaseURL(srv.URL)
+	s := a.NewCheckScheduler()
+
+	changed, err := s.Refresh()
+	if err != nil || !changed {
+		t.Fatalf("first Refresh() = %v, %v, want true", changed, err)
+	}
+	if len(s.checks) != 2 || s.interval != 300 {
+		t.Fatalf("Refresh() scheduled %d checks every %ds, want 2 every 300s", len(s.checks), s.interval)
+	}
+	next := s.checks[1].next
+
+	changed, err = s.Refresh()
+	if err != nil || changed {
+		t.Fatalf("second Refresh() = %v, %v, want false", changed, err)
+	}
+	if notModified != 1 {
+		t.Errorf("If-None-Match was not sent, %d of %d requests answered 304", notModified, requests)
+	}
+	if !s.checks[1].next.Equal(next) {
+		t.Error("an unchanged refresh rescheduled the checks")
+	}
+}
+
+func TestSchedulerRefreshUnchangedBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Checks": [{"id": 1, "check_type": "ping"}]}`))
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t)
+	a.rClient = resty.New().SetBaseURL(srv.URL)
+	s := a.NewCheckScheduler()
+
+	if changed, err := s.Refresh(); err != nil || !changed {
+		t.Fatalf("first Refresh() = %v, %v, want true", changed, err)
+	}
+	if changed, err := s.Refresh(); err != nil || changed {
+		t.Fatalf("Refresh() of an identical body = %v, %v, want false", changed, err)
+	}
+}
+
+func TestNextRefreshDelay(t *testing.T) {
+	base := CHECK_REFRESH_INTERVAL * time.Second
+	max := CHECK_REFRESH_MAX_INTERVAL * time.Second
+
+	if got := nextRefreshDelay(base, false); got != 2*base {
+		t.Errorf("nextRefreshDelay(unchanged) = %v, want %v", got, 2*base)
+	}
+	if got := nextRefreshDelay(max, false); got != max {
+		t.Errorf("nextRefreshDelay(max, unchanged) = %v, want %v", got, max)
+	}
+	if got := nextRefreshDelay(max, true); got != base {
+		t.Errorf("nextRefreshDelay(changed) = %v, want %v", got, base)
+	}
+}
+
+func TestSchedulerRunDue(t *testing.T) {
+	a := newTestAgent(t)
+	s := a.NewCheckScheduler()
+	past := time.Now().Add(-time.Second)
+	s.checks[1] = &scheduledCheck{check: rmm.Check{CheckPK: 1, CheckType: "unknown"}, interval: time.Minute, next: past}
+	s.checks[2] = &scheduledCheck{check: rmm.Check{CheckPK: 2, CheckType: "unknown"}, interval: time.Minute, next: past, running: true}
+
+	s.runDue(time.Now())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		done := !s.checks[1].running
+		s.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("check 1 did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.records) != 1 || s.records[0].ID != 1 {
+		t.Errorf("records = %+v, want a run of check 1 only", s.records)
+	}
+	if !s.checks[1].next.After(time.Now()) {
+		t.Error("check 1 was not rescheduled")
+	}
+	if !s.checks[2].next.Equal(past) {
+		t.Error("check 2 was run while its last run had not exited")
+	}
+}
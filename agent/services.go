@@ -0,0 +1,16 @@
+package agent
+
+const (
+	// Service checks with restart_if_stopped start the service at most this many times per run
+	SVC_CHECK_RESTART_ATTEMPTS = 3
+	// Seconds between restart attempts
+	SVC_CHECK_RESTART_DELAY = 10
+)
+
+// ServiceRestart result of restarting a stopped service from a service check
+type ServiceRestart struct {
+	Attempts int    `json:"attempts"`
+	Success  bool   `json:"success"`
+	Status   string `json:"status"`
+	ErrorMsg string `json:"errormsg"`
+}
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"time"
 
 	rmm "github.com/sarog/rmmagent/shared"
@@ -278,6 +279,44 @@ func (a *Agent) GetServices() []rmm.WindowsService {
 	return ret
 }
 
+// RestartService starts a stopped service, retrying at most attempts times
+func (a *Agent) RestartService(ctx context.Context, name string, attempts int) ServiceRestart {
+	ret := ServiceRestart{Status: "stopped"}
+	for ret.Attempts < attempts {
+		ret.Attempts++
+		a.Logger.Infoln("Service", name, "is stopped, starting it, attempt", ret.Attempts)
+
+		resp := a.ControlService(name, "start")
+		if !resp.Success {
+			ret.ErrorMsg = resp.ErrorMsg
+		} else {
+			WaitForService(name, "running", 3)
+		}
+
+		status, err := GetServiceStatus(name)
+		if err != nil {
+			ret.Status = "n/a"
+			ret.ErrorMsg = err.Error()
+			return ret
+		}
+		ret.Status = status
+		if status == "running" || status == "start_pending" {
+			ret.Success = true
+			ret.ErrorMsg = ""
+			return ret
+		}
+		if ret.Attempts == attempts || !sleepContext(ctx, SVC_CHECK_RESTART_DELAY*time.Second) {
+			break
+		}
+	}
+
+	if ret.ErrorMsg == "" {
+		ret.ErrorMsg = "Service is " + ret.Status
+	}
+	a.Logger.Errorln("Unable to start service", name+":", ret.ErrorMsg)
+	return ret
+}
+
 // WaitForService will wait for a service to be in X state for X retries
 func WaitForService(name string, status string, retries int) {
 	attempts := 0
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SCRIPT_SIGNATURE_VERSION prefixes every signed message so the format can change later
+	SCRIPT_SIGNATURE_VERSION = "rmm-script-v1"
+
+	// Exit code reported when a script is refused because of its signature
+	SCRIPT_EXIT_UNVERIFIED = 97
+)
+
+// ScriptSignatureError is returned when a script is unsigned or its signature does not match
+type ScriptSignatureError struct {
+	Reason string `json:"reason"` // unsigned, malformed, invalid
+	Shell  string `json:"shell"`
+}
+
+func (e *ScriptSignatureError) Error() string {
+	return fmt.Sprintf("script signature verification failed (%s): refusing to run %s script", e.Reason, e.Shell)
+}
+
+// ScriptSigningMessage returns the bytes covered by a script signature
+// Each field is encoded as a netstring ("<len>:<data>,") so the message is unambiguous:
+//
+//	version, shell, number of args, each arg, code
+func ScriptSigningMessage(code, shell string, args []string) []byte {
+	var b strings.Builder
+	netstring := func(s string) {
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+		b.WriteString(s)
+		b.WriteByte(',')
+	}
+
+	netstring(SCRIPT_SIGNATURE_VERSION)
+	netstring(shell)
+	netstring(strconv.Itoa(len(args)))
+	for _, arg := range args {
+		netstring(arg)
+	}
+	netstring(code)
+	return []byte(b.String())
+}
+
+// ParseScriptSigningKeys decodes base64 encoded Ed25519 public keys
+func ParseScriptSigningKeys(keys []string) ([]ed25519.PublicKey, error) {
+	ret := make([]ed25519.PublicKey, 0, len(keys))
+	for _, k := range keys {
+		k = StripAll(k)
+		if k == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid script signing key %q: %s", k, err)
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid script signing key %q: expected %d bytes, got %d", k, ed25519.PublicKeySize, len(raw))
+		}
+		ret = append(ret, ed25519.PublicKey(raw))
+	}
+	return ret, nil
+}
+
+// ScriptSigningEnabled returns true when signing keys have been pinned in the agent's configuration
+func (a *Agent) ScriptSigningEnabled() bool {
+	return len(a.ScriptSigningKeys) > 0
+}
+
+// VerifyScript checks the detached signature of a script against the pinned keys
+// Always succeeds when no keys are pinned
+func (a *Agent) VerifyScript(code, shell string, args []string, signature string) error {
+	if !a.ScriptSigningEnabled() {
+		return nil
+	}
+
+	if signature == "" {
+		return &ScriptSignatureError{Reason: "unsigned", Shell: shell}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return &ScriptSignatureError{Reason: "malformed", Shell: shell}
+	}
+
+	msg := ScriptSigningMessage(code, shell, args)
+	for _, key := range a.ScriptSigningKeys {
+		if ed25519.Verify(key, msg, sig) {
+			return nil
+		}
+	}
+	return &ScriptSignatureError{Reason: "invalid", Shell: shell}
+}
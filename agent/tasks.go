@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	rmm "github.com/sarog/rmmagent/shared"
+)
+
+// RunTask runs an automated task and reports its result
+// The exit code is nil when the task's script didn't run. A refused script is reported to the server
+// with SCRIPT_EXIT_UNVERIFIED, and its policy or signature error is returned.
+func (a *Agent) RunTask(id int) (exitCode *int, e error) {
+	lock, err := a.AcquireLock(taskLock(id))
+	if err != nil {
+		if errors.Is(err, ErrLocked) {
+			a.lockBusy(taskLock(id))
+		} else {
+			a.Logger.Debugln(err)
+		}
+		return nil, err
+	}
+	defer lock.Release()
+
+	data := rmm.AutomatedTask{}
+	// 2022-01-01: api/tacticalrmm/apiv3/views.py:306
+	url := fmt.Sprintf("/api/v3/%d/%s/taskrunner/", id, a.AgentID)
+
+	// 2022-01-01: api/tacticalrmm/apiv3/views.py:310
+	r1, gerr := a.rClient.R().Get(url)
+	if gerr != nil {
+		a.Logger.Debugln(gerr)
+		return nil, gerr
+	}
+
+	if r1.IsError() {
+		a.Logger.Debugln("Run Task:", r1.String())
+		return nil, fmt.Errorf("taskrunner response code: %v", r1.StatusCode())
+	}
+
+	if err := json.Unmarshal(r1.Body(), &data); err != nil {
+		a.Logger.Debugln(err)
+		return nil, err
+	}
+
+	var (
+		stdout, stderr string
+		retcode        int
+		artifacts      []OutputArtifact
+		runErr         error
+	)
+
+	start := time.Now()
+	if err := a.AuthorizeScript(NATS_CMD_TASK_RUN, data.TaskScript.Code, data.TaskScript.Shell, data.Args, data.TaskScript.Signature); err != nil {
+		a.Logger.Errorln("Run Task:", err)
+		stderr, retcode, runErr = err.Error(), SCRIPT_EXIT_UNVERIFIED, err
+	} else {
+		stdout, stderr, retcode, artifacts, runErr = a.RunScriptEnv(context.Background(), data.TaskScript.Code, data.TaskScript.Shell, data.Args, data.Timeout, data.TaskScript.Env, data.TaskScript.Secrets)
+	}
+
+	type TaskResult struct {
+		Stdout    string           `json:"stdout"`
+		Stderr    string           `json:"stderr"`
+		RetCode   int              `json:"retcode"`
+		ExecTime  float64          `json:"execution_time"`
+		Artifacts []OutputArtifact `json:"artifacts,omitempty"`
+	}
+
+	payload := TaskResult{
+		Stdout:    stdout,
+		Stderr:    stderr,
+		RetCode:   retcode,
+		ExecTime:  time.Since(start).Seconds(),
+		Artifacts: artifacts,
+	}
+
+	// 2022-01-01: api/tacticalrmm/apiv3/views.py:315
+	_, perr := a.rClient.R().SetBody(payload).Patch(url)
+	if perr != nil {
+		a.Logger.Debugln(perr)
+		if runErr == nil {
+			runErr = perr
+		}
+	}
+	return &retcode, runErr
+}
@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,59 +8,10 @@ import (
 	"time"
 
 	"github.com/capnspacehook/taskmaster"
-	rmm "github.com/sarog/rmmagent/shared"
 )
 
 const TASK_PREFIX = "RMM_"
 
-func (a *Agent) RunTask(id int) error {
-	data := rmm.AutomatedTask{}
-	// 2022-01-01: api/tacticalrmm/apiv3/views.py:306
-	url := fmt.Sprintf("/api/v3/%d/%s/taskrunner/", id, a.AgentID)
-
-	// 2022-01-01: api/tacticalrmm/apiv3/views.py:310
-	r1, gerr := a.rClient.R().Get(url)
-	if gerr != nil {
-		a.Logger.Debugln(gerr)
-		return gerr
-	}
-
-	if r1.IsError() {
-		a.Logger.Debugln("Run Task:", r1.String())
-		return nil
-	}
-
-	if err := json.Unmarshal(r1.Body(), &data); err != nil {
-		a.Logger.Debugln(err)
-		return err
-	}
-
-	start := time.Now()
-	stdout, stderr, retcode, _ := a.RunScript(data.TaskScript.Code, data.TaskScript.Shell, data.Args, data.Timeout)
-
-	type TaskResult struct {
-		Stdout   string  `json:"stdout"`
-		Stderr   string  `json:"stderr"`
-		RetCode  int     `json:"retcode"`
-		ExecTime float64 `json:"execution_time"`
-	}
-
-	payload := TaskResult{
-		Stdout:   stdout,
-		Stderr:   stderr,
-		RetCode:  retcode,
-		ExecTime: time.Since(start).Seconds(),
-	}
-
-	// 2022-01-01: api/tacticalrmm/apiv3/views.py:315
-	_, perr := a.rClient.R().SetBody(payload).Patch(url)
-	if perr != nil {
-		a.Logger.Debugln(perr)
-		return perr
-	}
-	return nil
-}
-
 // CreateInternalTask creates predefined RMM agent internal tasks
 func (a *Agent) CreateInternalTask(name, args, repeat string, start int) (bool, error) {
 	conn, err := taskmaster.Connect()
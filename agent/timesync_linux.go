@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"time"
+)
+
+// getTimeSyncStatus asks chrony, then systemd-timesyncd through timedatectl
+func getTimeSyncStatus(ctx context.Context) (TimeSyncStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if path, err := exec.LookPath("chronyc"); err == nil {
+		if out, status, err := CommandOutput(ctx, path, "-c", "tracking"); err == nil && status == 0 {
+			return ParseChronyTracking(string(out))
+		}
+	}
+	if path, err := exec.LookPath("timedatectl"); err == nil {
+		if out, status, err := CommandOutput(ctx, path, "show"); err == nil && status == 0 {
+			return ParseTimedatectl(string(out))
+		}
+	}
+	return TimeSyncStatus{}, errors.New("no time synchronization service found")
+}
@@ -0,0 +1,23 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// getTimeSyncStatus asks the Windows Time service
+func getTimeSyncStatus(ctx context.Context) (TimeSyncStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	out, status, err := CommandOutput(ctx, "w32tm.exe", "/query", "/status")
+	if err != nil {
+		return TimeSyncStatus{Service: "w32time"}, err
+	}
+	if status != 0 {
+		// e.g. the service is not started
+		return TimeSyncStatus{Service: "w32time"}, fmt.Errorf("w32tm exit status %d: %s", status, out)
+	}
+	return ParseW32tmStatus(string(out))
+}
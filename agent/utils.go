@@ -2,14 +2,20 @@ package agent
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
 	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,6 +24,9 @@ import (
 	"github.com/shirou/gopsutil/v3/process"
 )
 
+// REDACTED replaces secret values in logs and script output
+const REDACTED = "********"
+
 // PublicIP returns the agent's public IP address
 // Tries 3 times before giving up
 func (a *Agent) PublicIP() string {
@@ -147,6 +156,183 @@ func KillProc(pid int32) error {
 	return nil
 }
 
+// EnvList converts a map of environment variables to a sorted list of KEY=value pairs
+func EnvList(env map[string]string) []string {
+	ret := make([]string, 0, len(env))
+	for k, v := range env {
+		if k == "" {
+			continue
+		}
+		ret = append(ret, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// RedactSecrets replaces every secret value found in s
+func RedactSecrets(s string, secrets map[string]string) string {
+	var b strings.Builder
+	w := NewRedactWriter(&b, secrets)
+	w.Write([]byte(s))
+	w.Close()
+	return b.String()
+}
+
+// RedactWriter replaces secret values in a stream before passing it on
+// The last bytes, one less than the longest secret, are held back until more of the stream
+// is written or Close is called, so a secret split across writes is still redacted.
+type RedactWriter struct {
+	w       io.Writer
+	values  [][]byte
+	keep    int
+	pending []byte
+}
+
+// NewRedactWriter creates a RedactWriter writing to w
+func NewRedactWriter(w io.Writer, secrets map[string]string) *RedactWriter {
+	r := &RedactWriter{w: w}
+	for _, v := range secrets {
+		if v != "" {
+			r.values = append(r.values, []byte(v))
+		}
+	}
+	// Longest first, so a secret containing another one is fully redacted
+	sort.Slice(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+	if len(r.values) > 0 {
+		r.keep = len(r.values[0]) - 1
+	}
+	return r
+}
+
+func (r *RedactWriter) Write(p []byte) (int, error) {
+	if len(r.values) == 0 {
+		return r.w.Write(p)
+	}
+	r.pending = append(r.pending, p...)
+	if err := r.flush(len(r.pending) - r.keep); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the bytes held back
+func (r *RedactWriter) Close() error {
+	return r.flush(len(r.pending))
+}
+
+// flush writes the pending bytes before end, any secret starting there being redacted whole
+func (r *RedactWriter) flush(end int) error {
+	if end <= 0 {
+		return nil
+	}
+	out := make([]byte, 0, end)
+	i := 0
+	for i < end {
+		matched := false
+		for _, v := range r.values {
+			if bytes.HasPrefix(r.pending[i:], v) {
+				out = append(out, REDACTED...)
+				i += len(v)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			out = append(out, r.pending[i])
+			i++
+		}
+	}
+	r.pending = append(r.pending[:0], r.pending[i:]...)
+	_, err := r.w.Write(out)
+	return err
+}
+
+// scriptWriters returns the writers for a script's output, which redact its secrets before they reach
+// the output buffers, stdout also being written to tee when it isn't nil
+// close must be called once the script has exited, before the buffers are read.
+func scriptWriters(outb, errb *OutputBuffer, tee io.Writer, secrets map[string]string) (stdout, stderr io.Writer, close func()) {
+	stdout, stderr = outb, errb
+	if tee != nil {
+		stdout = io.MultiWriter(outb, tee)
+	}
+	if len(secrets) == 0 {
+		return stdout, stderr, func() {}
+	}
+	rout, rerr := NewRedactWriter(stdout, secrets), NewRedactWriter(stderr, secrets)
+	return rout, rerr, func() {
+		rout.Close()
+		rerr.Close()
+	}
+}
+
+// WipeFile overwrites a file with zeros before removing it
+func WipeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err == nil {
+		if fi, err := f.Stat(); err == nil {
+			f.Write(make([]byte, fi.Size()))
+			f.Sync()
+		}
+		f.Close()
+	}
+	return os.Remove(path)
+}
+
+// CommandOutput runs a command and returns its standard output and exit status
+// A non zero exit status is not an error, for commands reporting a state through it.
+func CommandOutput(ctx context.Context, exe string, args ...string) ([]byte, int, error) {
+	out, err := exec.CommandContext(ctx, exe, args...).Output()
+	if ctx.Err() != nil {
+		return nil, 0, fmt.Errorf("%s: %s", filepath.Base(exe), ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return out, exitErr.ExitCode(), nil
+	}
+	return out, 0, err
+}
+
+// compilePatterns compiles include and exclude regular expressions
+func compilePatterns(includes, excludes []string) (include, exclude []*regexp.Regexp, err error) {
+	for _, expr := range includes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("include pattern: %s", err)
+		}
+		include = append(include, re)
+	}
+	for _, expr := range excludes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("exclude pattern: %s", err)
+		}
+		exclude = append(exclude, re)
+	}
+	return include, exclude, nil
+}
+
+// matchPatterns returns true when s matches an include pattern, or there are none, and no exclude pattern
+func matchPatterns(s string, include, exclude []*regexp.Regexp) bool {
+	if len(include) > 0 {
+		included := false
+		for _, re := range include {
+			if re.MatchString(s) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, re := range exclude {
+		if re.MatchString(s) {
+			return false
+		}
+	}
+	return true
+}
+
 // DjangoStringResp removes double quotes from a Django REST API response
 func DjangoStringResp(resp string) string {
 	return strings.Trim(resp, `"`)
@@ -213,3 +399,20 @@ func Unzip(src, dest string) error {
 	}
 	return nil
 }
+
+func randRange(min, max int) int {
+	rand.Seed(time.Now().UnixNano())
+	return rand.Intn(max-min) + min
+}
+
+// sleepContext waits for d, returning false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
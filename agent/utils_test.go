@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactWriter(t *testing.T) {
+	secrets := map[string]string{"TOKEN": "s3cr3t-token", "SHORT": "s3cr3t", "EMPTY": ""}
+	out := "token=s3cr3t-token short=s3cr3t again=s3cr3t-token end"
+	want := "token=" + REDACTED + " short=" + REDACTED + " again=" + REDACTED + " end"
+
+	// Every split of the stream, so secrets straddle writes
+	for size := 1; size <= len(out); size++ {
+		var b strings.Builder
+		w := NewRedactWriter(&b, secrets)
+		for i := 0; i < len(out); i += size {
+			end := i + size
+			if end > len(out) {
+				end = len(out)
+			}
+			w.Write([]byte(out[i:end]))
+		}
+		w.Close()
+		if b.String() != want {
+			t.Fatalf("writes of %d bytes: %q, want %q", size, b.String(), want)
+		}
+	}
+}
+
+func TestRedactWriterBeforeTruncation(t *testing.T) {
+	secret := strings.Repeat("x", 40)
+	outb := NewOutputBuffer(64, "")
+	w := NewRedactWriter(outb, map[string]string{"KEY": secret})
+
+	// The secret spans the point where the buffer starts dropping output
+	w.Write([]byte(strings.Repeat("a", 20) + secret[:20]))
+	w.Write([]byte(secret[20:] + strings.Repeat("b", 200) + secret))
+	w.Close()
+
+	if got := outb.String(); strings.Contains(got, secret[:8]) {
+		t.Errorf("output contains part of the secret: %q", got)
+	}
+}
+
+func TestRedactSecretsWithoutSecrets(t *testing.T) {
+	if got := RedactSecrets("nothing to hide", nil); got != "nothing to hide" {
+		t.Errorf("RedactSecrets() = %q", got)
+	}
+}
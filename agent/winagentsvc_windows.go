@@ -2,7 +2,6 @@ package agent
 
 import (
 	"fmt"
-	"math/rand"
 	"sync"
 	"time"
 
@@ -40,6 +39,7 @@ const (
 func (a *Agent) RunAgentService() {
 	var wg sync.WaitGroup
 	wg.Add(1)
+	go a.cpu.Run()
 	go a.WinAgentSvc()
 	go a.CheckRunner()
 	wg.Wait()
@@ -291,8 +291,3 @@ func (a *Agent) CheckIn(mode string) {
 		}
 	}
 }
-
-func randRange(min, max int) int {
-	rand.Seed(time.Now().UnixNano())
-	return rand.Intn(max-min) + min
-}
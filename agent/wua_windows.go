@@ -479,18 +479,25 @@ func (s *IUpdateSession) GetWUAUpdateCollection(query string) (*IUpdateCollectio
 
 // SystemRebootRequired checks whether a system reboot is required.
 func (a *Agent) SystemRebootRequired() (bool, error) {
-	regKeys := []string{
-		`SOFTWARE\Microsoft\Windows\CurrentVersion\WindowsUpdate\Auto Update\RebootRequired`,
+	status, err := a.GetRebootStatus()
+	return status.Required, err
+}
+
+// GetRebootStatus checks the registry keys set when a reboot is pending
+func (a *Agent) GetRebootStatus() (RebootStatus, error) {
+	status := RebootStatus{Reasons: make([]RebootReason, 0)}
+	regKeys := map[string]string{
+		"windows-update": `SOFTWARE\Microsoft\Windows\CurrentVersion\WindowsUpdate\Auto Update\RebootRequired`,
 	}
-	for _, key := range regKeys {
+	for source, key := range regKeys {
 		k, err := registry.OpenKey(registry.LOCAL_MACHINE, key, registry.QUERY_VALUE)
 		if err == nil {
 			k.Close()
-			return true, nil
+			status.add(RebootReason{Source: source, Detail: key})
 		} else if err != registry.ErrNotExist {
-			return false, err
+			return status, err
 		}
 	}
 
-	return false, nil
+	return status, nil
 }
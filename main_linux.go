@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sarog/rmmagent/agent"
+)
+
+func main() {
+	ver := flag.Bool("version", false, "Prints agent version and exits")
+	mode := flag.String("m", "", "The mode to run: agentsvc, runchecks, checkrunner, taskrunner, pk, publicip, rebootstatus, auditverify")
+	taskPK := flag.Int("p", 0, "Task PK")
+	logLevel := flag.String("log", "INFO", "Log level: INFO*, WARN, ERROR, DEBUG")
+	logTo := flag.String("logto", "file", "Log destination: file, stdout")
+	flag.Parse()
+
+	if *ver {
+		agent.ShowVersionInfo(version)
+		return
+	}
+
+	if len(os.Args) == 1 {
+		agent.ShowStatus(version)
+		return
+	}
+
+	setupLogging(logLevel, logTo)
+	defer logFile.Close()
+
+	a := *agent.New(log, version)
+
+	switch *mode {
+	case AGENT_MODE_SVC:
+		a.RunAgentService()
+	case AGENT_MODE_RUNCHECKS:
+		a.RunChecks(true)
+	case AGENT_MODE_CHECKRUNNER:
+		a.RunChecks(false)
+	case AGENT_MODE_TASKRUNNER, AGENT_MODE_TASK:
+		if *taskPK == 0 {
+			return
+		}
+		a.RunTask(*taskPK)
+	case AGENT_MODE_PK:
+		fmt.Println(a.AgentPK)
+	case AGENT_MODE_PUBLICIP:
+		fmt.Println(a.PublicIP())
+	case AGENT_MODE_REBOOTSTATUS:
+		status, err := a.GetRebootStatus()
+		if err != nil {
+			log.Errorln(err)
+		}
+		out, _ := json.MarshalIndent(status, "", "  ")
+		fmt.Println(string(out))
+	case AGENT_MODE_AUDITVERIFY:
+		if err := a.VerifyAuditLog(); err != nil {
+			os.Exit(1)
+		}
+	default:
+		agent.ShowStatus(version)
+	}
+}
+
+func agentLogFile() string {
+	os.MkdirAll(agent.AGENT_LOG_DIR, 0755)
+	return filepath.Join(agent.AGENT_LOG_DIR, AGENT_LOG_FILE)
+}
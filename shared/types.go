@@ -4,8 +4,9 @@ import "time"
 
 // 2021-12-31: api/tacticalrmm/apiv3/views.py:524
 type RecoveryAction struct {
-	Mode     string `json:"mode"` // command, rpc
-	ShellCMD string `json:"shellcmd"`
+	Mode      string `json:"mode"` // command, rpc
+	ShellCMD  string `json:"shellcmd"`
+	Signature string `json:"signature"` // of ShellCMD, required when the agent has ScriptSigningKeys pinned
 }
 
 // 2021-12-31: api/tacticalrmm/apiv3/views.py:172
@@ -93,8 +94,13 @@ type AssignedTask struct {
 }
 
 type Script struct {
-	Shell string `json:"shell"`
-	Code  string `json:"code"`
+	Shell   string            `json:"shell"`
+	Code    string            `json:"code"`
+	Env     map[string]string `json:"env"`
+	Secrets map[string]string `json:"secrets"` // only exposed to the script as environment variables
+
+	// Signature base64 encoded, detached Ed25519 signature over the code, shell and args
+	Signature string `json:"signature"`
 }
 
 type CheckInfo struct {
@@ -125,12 +131,139 @@ type Check struct {
 	EventMessage     string         `json:"event_message"`
 	FailWhen         string         `json:"fail_when"`
 	SearchLastDays   int            `json:"search_last_days"`
+	RunInterval      int            `json:"run_interval"` // seconds, 0 uses the agent's check interval
+
+	// nagios, a Monitoring Plugins executable run with ScriptArgs instead of Script
+	PluginPath string `json:"plugin_path"`
+
+	// http
+	URL             string            `json:"url"`
+	Method          string            `json:"method"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	ExpectedStatus  []int             `json:"expected_status"`
+	BodyRegex       string            `json:"body_regex"`
+	JSONAssertions  []JSONAssertion   `json:"json_assertions"`
+	FollowRedirects bool              `json:"follow_redirects"`
+	MaxRedirects    int               `json:"max_redirects"`
+
+	// tcp, tlscert
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	BannerRegex string `json:"banner_regex"`
+	ServerName  string `json:"server_name"` // SNI and name verified in the certificate, defaults to Host
+
+	// Thresholds of the built-in checks, in the unit of the value each one evaluates:
+	//   tcp, ping, dns: response time in ms; timesync: clock offset in ms
+	//   tlscert: days until the certificate expires (fails at or below)
+	//   cpu, memory: percent used
+	//   diskspace: percent free (fails below)
+	//   smart, sensors: temperature in °C
+	//   logfile: number of matching lines
+	WarningThreshold int `json:"warning_threshold"`
+	ErrorThreshold   int `json:"error_threshold"`
+
+	// ping, thresholds above are the average round trip in ms
+	PingCount            int `json:"ping_count"`
+	LossWarningThreshold int `json:"loss_warning_threshold"` // percent
+	LossErrorThreshold   int `json:"loss_error_threshold"`   // percent
+
+	// dns, thresholds above are the response time in ms
+	DNSName         string   `json:"dns_name"`
+	RecordType      string   `json:"record_type"`
+	Resolver        string   `json:"resolver"` // ip or ip:port, empty uses the system resolver
+	ExpectedAnswers []string `json:"expected_answers"`
+	ExpectedRCode   string   `json:"expected_rcode"` // defaults to NOERROR
+
+	// process
+	ProcessName   string  `json:"process_name"`
+	ProcessExe    string  `json:"process_exe"`
+	CmdlineRegex  string  `json:"cmdline_regex"`
+	MinCount      *int    `json:"min_count"` // defaults to 1
+	MaxCount      *int    `json:"max_count"` // unlimited when not set
+	MaxCPUPercent float64 `json:"max_cpu_percent"`
+	MaxRSSMB      int     `json:"max_rss_mb"`
+
+	// file, min_count and max_count above apply to the files matching FileGlob
+	Path          string `json:"path"`      // file, or directory with FileGlob
+	FileGlob      string `json:"file_glob"` // e.g. *.bak
+	ShouldExist   *bool  `json:"should_exist"`
+	MinSizeBytes  int64  `json:"min_size_bytes"`
+	MaxSizeBytes  int64  `json:"max_size_bytes"`
+	MaxAgeMinutes int    `json:"max_age_minutes"`
+	ContentRegex  string `json:"content_regex"`
+
+	// logfile, uses Path, thresholds above are the number of matching lines
+	// systemd matches the patterns against failed unit names, and uses RestartIfStopped to restart them
+	IncludePatterns []string `json:"include_patterns"` // every line matches when empty
+	ExcludePatterns []string `json:"exclude_patterns"`
+	FromStart       bool     `json:"from_start"` // read existing lines on the first run
+
+	// cpuload, thresholds above are the usage percent
+	// the agent evaluates the check when any of these is set, otherwise the server does
+	CoreWarningThreshold   int     `json:"core_warning_threshold"` // percent of the busiest core
+	CoreErrorThreshold     int     `json:"core_error_threshold"`   // percent of the busiest core
+	IOWaitWarningThreshold int     `json:"iowait_warning_threshold"`
+	IOWaitErrorThreshold   int     `json:"iowait_error_threshold"`
+	StealWarningThreshold  int     `json:"steal_warning_threshold"`
+	StealErrorThreshold    int     `json:"steal_error_threshold"`
+	LoadWarningThreshold   float64 `json:"load_warning_threshold"` // 5 minute load average per core, Linux only
+	LoadErrorThreshold     float64 `json:"load_error_threshold"`   // 5 minute load average per core, Linux only
+
+	// memory, thresholds above are the used percent
+	// the agent evaluates the check when any of these is set, otherwise the server does
+	SwapWarningThreshold   int `json:"swap_warning_threshold"`   // percent
+	SwapErrorThreshold     int `json:"swap_error_threshold"`     // percent
+	AvailableWarningMB     int `json:"available_warning_mb"`     // fails below
+	AvailableErrorMB       int `json:"available_error_mb"`       // fails below
+	CommitWarningThreshold int `json:"commit_warning_threshold"` // percent of the commit limit
+	CommitErrorThreshold   int `json:"commit_error_threshold"`   // percent of the commit limit
+	MajorFaultWarningRate  int `json:"major_fault_warning_rate"` // hard page faults per second
+	MajorFaultErrorRate    int `json:"major_fault_error_rate"`   // hard page faults per second
+
+	// smart, raid, sensors, thresholds above are the temperature in °C
+	Device    string `json:"device"`      // disk, array or hwmon chip name, all of them when empty
+	MinFanRPM int    `json:"min_fan_rpm"` // defaults to the chip's minimum when it reports one
+
+	// timesync, uses Host and Port for an NTP server or the RMM server when empty, thresholds above are the offset in ms
+	RequireSync bool `json:"require_sync"` // warn when the local time service is not synchronized
+
+	// local failure and flap suppression, see agent.CheckRunState
+	FailsBeforeAlert     int `json:"fails_b4_alert"`
+	PassesBeforeRecovery int `json:"passes_b4_recovery"`
+	FlapHighThreshold    int `json:"flap_high_threshold"` // percent of state changes, 0 disables flap detection
+	FlapLowThreshold     int `json:"flap_low_threshold"`
+}
+
+// JSONAssertion compares the value at a path of a JSON response, e.g. $.status
+// A nil Value only requires the path to exist
+type JSONAssertion struct {
+	Path  string  `json:"path"`
+	Value *string `json:"value"`
 }
 
 // 2021-12-31: api/tacticalrmm/apiv3/views.py:233
 type AllChecks struct {
 	CheckInfo
 	Checks []Check
+	// Replaces the agent's maintenance windows when present
+	MaintenanceWindows []MaintenanceWindow `json:"maintenance_windows"`
+}
+
+// MaintenanceWindow a period during which checks are suppressed and their tasks are not run
+// One-off windows use Start and End (RFC3339), recurring ones StartTime (HH:MM, agent local time),
+// Duration and Weekdays (mon, tue...; every day when empty)
+type MaintenanceWindow struct {
+	ID         string   `json:"id"`
+	Start      string   `json:"start"`
+	End        string   `json:"end"`
+	StartTime  string   `json:"start_time"`
+	Duration   int      `json:"duration"` // minutes
+	Weekdays   []string `json:"weekdays"`
+	CheckTypes []string `json:"check_types"` // every check type when empty
+	Action     string   `json:"action"`      // skip, or maintenance (default) to report the check as in maintenance
+	Comment    string   `json:"comment"`
+	Source     string   `json:"source,omitempty"` // set by the agent: local (setmaintenance) or server
 }
 
 type AutomatedTask struct {